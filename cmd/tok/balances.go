@@ -39,8 +39,13 @@ func balancesListCmd() *cobra.Command {
 			fmt.Printf("Accounts balances at %x:\n", state.LatestBlockHash())
 			fmt.Println("__________________")
 			fmt.Println("")
+			spendable := state.SpendableBalances()
 			for account, balance := range state.Balances {
-				fmt.Println(fmt.Sprintf("%s: %d", account, balance))
+				if spendable[account] != balance {
+					fmt.Println(fmt.Sprintf("%s: %s TOK (%s TOK spendable)", account, balance, spendable[account]))
+					continue
+				}
+				fmt.Println(fmt.Sprintf("%s: %s TOK", account, balance))
 			}
 		},
 	}
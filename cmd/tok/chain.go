@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+	"github.com/spf13/cobra"
+)
+
+const flagFrom = "from"
+const flagTo = "to"
+const flagOut = "out"
+const flagIn = "in"
+
+func chainCmd() *cobra.Command {
+	var chainCmd = &cobra.Command{
+		Use:   "chain",
+		Short: "Move blocks between data dirs (export, import...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	chainCmd.AddCommand(chainExportCmd())
+	chainCmd.AddCommand(chainImportCmd())
+
+	return chainCmd
+}
+
+func chainExportCmd() *cobra.Command {
+	var chainExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Writes a range of blocks to a portable file.",
+		Run: func(cmd *cobra.Command, args []string) {
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer state.Close()
+
+			from, _ := cmd.Flags().GetUint64(flagFrom)
+			to := state.LatestBlock().Header.Number
+			if cmd.Flags().Changed(flagTo) {
+				to, _ = cmd.Flags().GetUint64(flagTo)
+			}
+			if from > to {
+				fmt.Fprintf(os.Stderr, "--%s must not be after --%s\n", flagFrom, flagTo)
+				os.Exit(1)
+			}
+			if to > state.LatestBlock().Header.Number {
+				fmt.Fprintf(os.Stderr, "--%s must not be after the latest block #%d\n", flagTo, state.LatestBlock().Header.Number)
+				os.Exit(1)
+			}
+
+			out, _ := cmd.Flags().GetString(flagOut)
+			f, err := os.Create(out)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			header := database.ChainExportHeader{
+				ChainID:     state.ChainID(),
+				GenesisHash: state.GenesisHash(),
+				From:        from,
+				To:          to,
+			}
+			exported, err := database.ExportBlocks(getDataDirFromCmd(cmd), header, f)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Exported %d blocks (#%d to #%d) to %s\n", exported, from, to, out)
+		},
+	}
+
+	addDefaultRequiredFlags(chainExportCmd)
+	chainExportCmd.Flags().Uint64(flagFrom, 0, "first block number to export")
+	chainExportCmd.Flags().Uint64(flagTo, 0, "last block number to export, defaults to the latest block")
+	chainExportCmd.Flags().String(flagOut, "", "path of the export file to write")
+	chainExportCmd.MarkFlagRequired(flagOut)
+	return chainExportCmd
+}
+
+func chainImportCmd() *cobra.Command {
+	var chainImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Validates and appends blocks from an export file.",
+		Run: func(cmd *cobra.Command, args []string) {
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer state.Close()
+
+			in, _ := cmd.Flags().GetString(flagIn)
+			f, err := os.Open(in)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			header, blocks, err := database.ReadChainExport(f)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			if header.ChainID != state.ChainID() || header.GenesisHash != state.GenesisHash() {
+				fmt.Fprintf(os.Stderr, "export is from chain '%s' with genesis '%x', this data dir is chain '%s' with genesis '%x'\n",
+					header.ChainID, header.GenesisHash, state.ChainID(), state.GenesisHash())
+				os.Exit(1)
+			}
+
+			// Blocks we already have are skipped, the rest must extend our latest block
+			newBlocks, err := skipKnownBlocks(state, blocks, getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			err = state.AddBlocks(newBlocks)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Imported %d new blocks, latest block is now #%d\n", len(newBlocks), state.LatestBlock().Header.Number)
+		},
+	}
+
+	addDefaultRequiredFlags(chainImportCmd)
+	chainImportCmd.Flags().String(flagIn, "", "path of the export file to import")
+	chainImportCmd.MarkFlagRequired(flagIn)
+	return chainImportCmd
+}
+
+// skipKnownBlocks drops the imported blocks we already have. An imported block at a height
+// we already have must be our block, otherwise the export comes from another fork.
+func skipKnownBlocks(state *database.State, blocks []database.Block, dataDir string) ([]database.Block, error) {
+	ours := make(map[uint64]database.Hash)
+	if !state.LatestBlockHash().IsEmpty() {
+		headers, err := database.GetHeadersUpTo(state.LatestBlockHash(), dataDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range headers {
+			ours[h.Header.Number] = h.Key
+		}
+	}
+
+	newBlocks := make([]database.Block, 0)
+	for _, b := range blocks {
+		if b.Header.Number >= state.NextBlockNumber() {
+			newBlocks = append(newBlocks, b)
+			continue
+		}
+
+		hash, err := b.Hash()
+		if err != nil {
+			return nil, err
+		}
+		if hash != ours[b.Header.Number] {
+			return nil, fmt.Errorf("export diverges from this chain at block #%d: '%x' is not our block '%x'", b.Header.Number, hash, ours[b.Header.Number])
+		}
+	}
+	return newBlocks, nil
+}
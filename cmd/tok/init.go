@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+	"github.com/harshrpg/go-blockchain-tut/fs"
+	"github.com/spf13/cobra"
+)
+
+func initCmd() *cobra.Command {
+	var initCmd = &cobra.Command{
+		Use:   "init",
+		Short: "Initialises a fresh data dir with a custom genesis.",
+		Run: func(cmd *cobra.Command, args []string) {
+			genHash, err := initDataDirFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Data dir %s initialised with genesis %x\n", getDataDirFromCmd(cmd), genHash)
+		},
+	}
+
+	addDefaultRequiredFlags(initCmd)
+	initCmd.Flags().String(flagGenesis, "", "path to the genesis JSON file to install")
+	initCmd.MarkFlagRequired(flagGenesis)
+	return initCmd
+}
+
+func initDataDirFromCmd(cmd *cobra.Command) (database.Hash, error) {
+	genesisPath, _ := cmd.Flags().GetString(flagGenesis)
+	return database.InitDataDir(getDataDirFromCmd(cmd), fs.ExpandPath(genesisPath))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+	"github.com/spf13/cobra"
+)
+
+const flagPrivateKey = "private-key"
+const flagTx = "tx"
+const flagChainID = "chain-id"
+
+func keysCmd() *cobra.Command {
+	var keysCmd = &cobra.Command{
+		Use:   "keys",
+		Short: "Manage keys of multisig account owners (generate, sign...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	keysCmd.AddCommand(keysGenerateCmd())
+	keysCmd.AddCommand(keysSignCmd())
+
+	return keysCmd
+}
+
+func keysGenerateCmd() *cobra.Command {
+	var keysGenerateCmd = &cobra.Command{
+		Use:   "generate",
+		Short: "Generates a new ed25519 key pair.",
+		Run: func(cmd *cobra.Command, args []string) {
+			pubKey, privKey, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Public key:  %s\n", hex.EncodeToString(pubKey))
+			fmt.Printf("Private key: %s\n", hex.EncodeToString(privKey))
+		},
+	}
+
+	return keysGenerateCmd
+}
+
+func keysSignCmd() *cobra.Command {
+	var keysSignCmd = &cobra.Command{
+		Use:   "sign",
+		Short: "Signs a tx sent from a multisig account.",
+		Run: func(cmd *cobra.Command, args []string) {
+			privKeyHex, _ := cmd.Flags().GetString(flagPrivateKey)
+			privKey, err := hex.DecodeString(privKeyHex)
+			if err != nil || len(privKey) != ed25519.PrivateKeySize {
+				fmt.Fprintln(os.Stderr, "invalid ed25519 private key")
+				os.Exit(1)
+			}
+
+			txJson, _ := cmd.Flags().GetString(flagTx)
+			var tx database.Tx
+			err = json.Unmarshal([]byte(txJson), &tx)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			chainID, _ := cmd.Flags().GetString(flagChainID)
+			sig, err := database.SignTx(tx, chainID, ed25519.PrivateKey(privKey))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			sigJson, _ := json.Marshal(sig)
+			fmt.Println(string(sigJson))
+		},
+	}
+
+	keysSignCmd.Flags().String(flagPrivateKey, "", "hex encoded ed25519 private key")
+	keysSignCmd.MarkFlagRequired(flagPrivateKey)
+	keysSignCmd.Flags().String(flagTx, "", "the tx to sign as JSON, e.g. '{\"from\":\"treasury\",\"to\":\"harsh\",\"value\":10,\"nonce\":1}'")
+	keysSignCmd.MarkFlagRequired(flagTx)
+	keysSignCmd.Flags().String(flagChainID, "", "id of the chain the tx is sent on, signatures are only valid on that chain")
+	keysSignCmd.MarkFlagRequired(flagChainID)
+	return keysSignCmd
+}
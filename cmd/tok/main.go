@@ -11,6 +11,13 @@ import (
 const flagDataDir = "datadir"
 const flagIP = "ip"
 const flagPort = "port"
+const flagSyncMode = "sync-mode"
+const flagCheckpoint = "checkpoint"
+const flagStateRoot = "state-root"
+const flagPrune = "prune"
+const flagPruneDepth = "prune-depth"
+const flagGenesis = "genesis"
+const flagBootstrap = "bootstrap"
 
 func main() {
 	var tokCmd = &cobra.Command{
@@ -21,9 +28,13 @@ func main() {
 	}
 
 	tokCmd.AddCommand(versionCmd)
+	tokCmd.AddCommand(initCmd())
 	tokCmd.AddCommand(balancesCmd())
 	tokCmd.AddCommand(runCmd())
 	tokCmd.AddCommand(migrateCmd())
+	tokCmd.AddCommand(chainCmd())
+	tokCmd.AddCommand(keysCmd())
+	tokCmd.AddCommand(tokenCmd())
 
 	err := tokCmd.Execute()
 	if err != nil {
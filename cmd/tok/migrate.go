@@ -21,15 +21,19 @@ var migrateCmd = func() *cobra.Command {
 			}
 			defer state.Close()
 
-			block0 := database.NewBlock(
+			block0, err := database.NewBlock(
 				database.Hash{},
 				state.NextBlockNumber(),
 				uint64(time.Now().Unix()),
 				[]database.Tx{
-					database.NewTx("owner", "owner", 3, ""),
-					database.NewTx("owner", "owner", 700, "reward"),
+					database.NewTx("owner", "owner", 3*database.TOK, ""),
+					database.NewTx("owner", "owner", 700*database.TOK, "reward"),
 				},
 			)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 
 			block0Hash, err := state.AddBlock(block0)
 			if err != nil {
@@ -37,19 +41,23 @@ var migrateCmd = func() *cobra.Command {
 				os.Exit(1)
 			}
 
-			block1 := database.NewBlock(
+			block1, err := database.NewBlock(
 				block0Hash,
 				state.NextBlockNumber(),
 				uint64(time.Now().Unix()),
 				[]database.Tx{
-					database.NewTx("owner", "harsh", 2000, ""),
-					database.NewTx("owner", "owner", 100, "reward"),
-					database.NewTx("harsh", "owner", 1, ""),
-					database.NewTx("harsh", "ishan", 1000, ""),
-					database.NewTx("harsh", "owner", 50, ""),
-					database.NewTx("owner", "owner", 600, "reward"),
+					database.NewTx("owner", "harsh", 2000*database.TOK, ""),
+					database.NewTx("owner", "owner", 100*database.TOK, "reward"),
+					database.NewTx("harsh", "owner", 1*database.TOK, ""),
+					database.NewTx("harsh", "ishan", 1000*database.TOK, ""),
+					database.NewTx("harsh", "owner", 50*database.TOK, ""),
+					database.NewTx("owner", "owner", 600*database.TOK, "reward"),
 				},
 			)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 
 			block1hash, err := state.AddBlock(block1)
 			if err != nil {
@@ -57,14 +65,18 @@ var migrateCmd = func() *cobra.Command {
 				os.Exit(1)
 			}
 
-			block2 := database.NewBlock(
+			block2, err := database.NewBlock(
 				block1hash,
 				state.NextBlockNumber(),
 				uint64(time.Now().Unix()),
 				[]database.Tx{
-					database.NewTx("owner", "owner", 24700, "reward"),
+					database.NewTx("owner", "owner", 24700*database.TOK, "reward"),
 				},
 			)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
 
 			_, err = state.AddBlock(block2)
 			if err != nil {
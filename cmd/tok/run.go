@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 
 	"github.com/harshrpg/go-blockchain-tut/node"
 	"github.com/spf13/cobra"
@@ -15,11 +17,35 @@ func runCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			ip, _ := cmd.Flags().GetString(flagIP)
 			port, _ := cmd.Flags().GetUint64(flagPort)
+			syncCfg, err := getSyncConfigFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			pruneDepth := uint64(0)
+			if prune, _ := cmd.Flags().GetBool(flagPrune); prune {
+				pruneDepth, _ = cmd.Flags().GetUint64(flagPruneDepth)
+				if pruneDepth == 0 {
+					fmt.Fprintf(os.Stderr, "--%s must be greater than 0\n", flagPruneDepth)
+					os.Exit(1)
+				}
+			}
+			if genesisPath, _ := cmd.Flags().GetString(flagGenesis); genesisPath != "" {
+				_, err = initDataDirFromCmd(cmd)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
 			fmt.Println("Launching the TBB node and its HTTP API...")
-			bootstrap := node.NewPeerNode("127.0.0.1", 8080, true, false)
-			n := node.New(getDataDirFromCmd(cmd), ip, port, bootstrap)
+			bootstraps, err := getBootstrapsFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			n := node.New(getDataDirFromCmd(cmd), ip, port, bootstraps, syncCfg, pruneDepth)
 
-			err := n.Run()
+			err = n.Run()
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -29,5 +55,57 @@ func runCmd() *cobra.Command {
 	addDefaultRequiredFlags(runCmd)
 	runCmd.Flags().String(flagIP, node.DefaultIP, "exposed IP for communication with peers")
 	runCmd.Flags().Uint64(flagPort, node.DefaultHTTPPort, "exposed HTTP port for communication with peers")
+	runCmd.Flags().String(flagSyncMode, node.SyncModeFull, "how a fresh node catches up: 'full' replays every block, 'snapshot' bootstraps from a peer's state snapshot")
+	runCmd.Flags().String(flagCheckpoint, "", "trusted block hash the snapshot's header chain must contain")
+	runCmd.Flags().String(flagStateRoot, "", "trusted state root the snapshot must match, required with --sync-mode snapshot")
+	runCmd.Flags().String(flagGenesis, "", "genesis JSON file the data dir must have been initialised with")
+	runCmd.Flags().Bool(flagPrune, false, "discard block bodies covered by a snapshot, keeping only their headers")
+	runCmd.Flags().Uint64(flagPruneDepth, 1000, "number of most recent block bodies kept in prune mode")
+	runCmd.Flags().StringArray(flagBootstrap, []string{fmt.Sprintf("%s:%d", node.DefaultIP, node.DefaultHTTPPort)}, "host:port of a bootstrap peer, repeat the flag for several peers")
 	return runCmd
 }
+
+func getBootstrapsFromCmd(cmd *cobra.Command) ([]node.PeerNode, error) {
+	addrs, _ := cmd.Flags().GetStringArray(flagBootstrap)
+	bootstraps := make([]node.PeerNode, 0, len(addrs))
+	for _, addr := range addrs {
+		host, portRaw, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peer '%s'. %s", addr, err.Error())
+		}
+		port, err := strconv.ParseUint(portRaw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peer port '%s'. %s", portRaw, err.Error())
+		}
+		bootstraps = append(bootstraps, node.NewPeerNode(host, port, true, false))
+	}
+	return bootstraps, nil
+}
+
+func getSyncConfigFromCmd(cmd *cobra.Command) (node.SyncConfig, error) {
+	mode, _ := cmd.Flags().GetString(flagSyncMode)
+	if mode != node.SyncModeFull && mode != node.SyncModeSnapshot {
+		return node.SyncConfig{}, fmt.Errorf("unknown sync mode '%s'", mode)
+	}
+
+	syncCfg := node.SyncConfig{Mode: mode}
+	checkpoint, _ := cmd.Flags().GetString(flagCheckpoint)
+	if checkpoint != "" {
+		err := syncCfg.Checkpoint.UnmarshalText([]byte(checkpoint))
+		if err != nil {
+			return node.SyncConfig{}, fmt.Errorf("invalid checkpoint. %s", err.Error())
+		}
+	}
+	stateRoot, _ := cmd.Flags().GetString(flagStateRoot)
+	if stateRoot != "" {
+		err := syncCfg.StateRoot.UnmarshalText([]byte(stateRoot))
+		if err != nil {
+			return node.SyncConfig{}, fmt.Errorf("invalid state root. %s", err.Error())
+		}
+	}
+	if mode == node.SyncModeSnapshot && syncCfg.StateRoot.IsEmpty() {
+		return node.SyncConfig{}, fmt.Errorf("--%s is required with --%s %s", flagStateRoot, flagSyncMode, node.SyncModeSnapshot)
+	}
+
+	return syncCfg, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+	"github.com/harshrpg/go-blockchain-tut/node"
+	"github.com/spf13/cobra"
+)
+
+const flagNode = "node"
+const flagIssuer = "issuer"
+const flagName = "name"
+const flagSupply = "supply"
+
+func tokenCmd() *cobra.Command {
+	var tokenCmd = &cobra.Command{
+		Use:   "token",
+		Short: "Interact with tokens (create, list...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	tokenCmd.AddCommand(tokenCreateCmd())
+	tokenCmd.AddCommand(tokenListCmd())
+
+	return tokenCmd
+}
+
+func tokenCreateCmd() *cobra.Command {
+	var tokenCreateCmd = &cobra.Command{
+		Use:   "create",
+		Short: "Issues a new token with a fixed supply through a running node.",
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeAddress, _ := cmd.Flags().GetString(flagNode)
+			issuer, _ := cmd.Flags().GetString(flagIssuer)
+			name, _ := cmd.Flags().GetString(flagName)
+			supplyRaw, _ := cmd.Flags().GetString(flagSupply)
+			supply, err := database.ParseAmount(supplyRaw)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			res, err := node.SendTx(nodeAddress, node.TxAddReq{
+				From:  issuer,
+				To:    issuer,
+				Value: supply,
+				Kind:  database.TxKindTokenCreate,
+				Asset: name,
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Token %s with supply %s issued by %s in block %x\n", name, supply, issuer, res.Hash)
+		},
+	}
+
+	tokenCreateCmd.Flags().String(flagNode, fmt.Sprintf("%s:%d", node.DefaultIP, node.DefaultHTTPPort), "address of the node to submit the tx to")
+	tokenCreateCmd.Flags().String(flagIssuer, "", "account issuing the token and receiving its supply")
+	tokenCreateCmd.MarkFlagRequired(flagIssuer)
+	tokenCreateCmd.Flags().String(flagName, "", "name of the token")
+	tokenCreateCmd.MarkFlagRequired(flagName)
+	tokenCreateCmd.Flags().String(flagSupply, "", "fixed supply of the token, e.g. 1000.5")
+	tokenCreateCmd.MarkFlagRequired(flagSupply)
+	return tokenCreateCmd
+}
+
+func tokenListCmd() *cobra.Command {
+	var tokenListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "Lists all tokens.",
+		Run: func(cmd *cobra.Command, args []string) {
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer state.Close()
+
+			fmt.Printf("Tokens at %x:\n", state.LatestBlockHash())
+			fmt.Println("__________________")
+			fmt.Println("")
+			for _, token := range state.Tokens() {
+				fmt.Println(fmt.Sprintf("%s: supply %s issued by %s", token.Name, token.Supply, token.Issuer))
+			}
+		},
+	}
+
+	addDefaultRequiredFlags(tokenListCmd)
+	return tokenListCmd
+}
@@ -0,0 +1,85 @@
+package database
+
+import "fmt"
+
+// applyApprove lets the recipient (spender) move up to tx.Value TOK from the sender (owner).
+// A new approval replaces the previous one, approving 0 revokes it.
+func applyApprove(tx Tx, s *State) error {
+	if tx.Asset != "" {
+		return fmt.Errorf("allowances are only supported for TOK")
+	}
+	if tx.To == "" || tx.To == tx.From {
+		return fmt.Errorf("invalid spender '%s'", tx.To)
+	}
+
+	s.emit(Event{Name: EventApproval, From: tx.From, To: tx.To, Value: tx.Value})
+	if tx.Value == 0 {
+		delete(s.allowances[tx.From], tx.To)
+		return nil
+	}
+
+	if _, ok := s.allowances[tx.From]; !ok {
+		s.allowances[tx.From] = make(map[Account]Amount)
+	}
+	s.allowances[tx.From][tx.To] = tx.Value
+	return nil
+}
+
+// applyTransferFrom moves TOK from tx.Owner to the recipient on behalf of the sender (spender)
+func applyTransferFrom(tx Tx, header BlockHeader, s *State) error {
+	if tx.Asset != "" {
+		return fmt.Errorf("allowances are only supported for TOK")
+	}
+
+	allowance := s.allowances[tx.Owner][tx.From]
+	if tx.Value > allowance {
+		return fmt.Errorf("spender '%s' is allowed %s TOK from '%s'. Tx cost is %s TOK", tx.From, allowance, tx.Owner, tx.Value)
+	}
+	if tx.Value > s.spendable(tx.Owner, header.Number) {
+		return fmt.Errorf("wrong Tx. Owner '%s' spendable balance is %s TOK. Tx cost is %s TOK", tx.Owner, s.spendable(tx.Owner, header.Number), tx.Value)
+	}
+
+	err := moveAmount(s.Balances, tx.Owner, tx.To, tx.Value)
+	if err != nil {
+		return err
+	}
+
+	if allowance == tx.Value {
+		delete(s.allowances[tx.Owner], tx.From)
+	} else {
+		s.allowances[tx.Owner][tx.From] = allowance - tx.Value
+	}
+	s.emit(Event{Name: EventTransfer, From: tx.Owner, To: tx.To, Value: tx.Value})
+	return nil
+}
+
+// AllowancesGranted returns how much each spender may still move from the owner
+func (s *State) AllowancesGranted(owner Account) map[Account]Amount {
+	granted := make(map[Account]Amount)
+	for spender, allowance := range s.allowances[owner] {
+		granted[spender] = allowance
+	}
+	return granted
+}
+
+// AllowancesReceived returns how much the spender may still move from each owner
+func (s *State) AllowancesReceived(spender Account) map[Account]Amount {
+	received := make(map[Account]Amount)
+	for owner, allowances := range s.allowances {
+		if allowance, ok := allowances[spender]; ok {
+			received[owner] = allowance
+		}
+	}
+	return received
+}
+
+func copyAllowances(allowances map[Account]map[Account]Amount) map[Account]map[Account]Amount {
+	c := make(map[Account]map[Account]Amount)
+	for owner, spenders := range allowances {
+		c[owner] = make(map[Account]Amount)
+		for spender, allowance := range spenders {
+			c[owner][spender] = allowance
+		}
+	}
+	return c
+}
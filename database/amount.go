@@ -0,0 +1,105 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Amounts are counted in the smallest unit, 1 TOK is 10^Decimals units (like wei and ether).
+// Genesis files, blocks and snapshots store them in TOK though, see MarshalJSON.
+const Decimals = 6
+const TOK Amount = 1000000
+
+var ErrOverflow = errors.New("amount overflows")
+var ErrUnderflow = errors.New("amount underflows")
+
+// Amount has a fixed width on every platform and all arithmetic on it is checked
+type Amount uint64
+
+func (a Amount) Add(b Amount) (Amount, error) {
+	sum, carry := bits.Add64(uint64(a), uint64(b), 0)
+	if carry != 0 {
+		return 0, fmt.Errorf("%w: %s + %s", ErrOverflow, a, b)
+	}
+	return Amount(sum), nil
+}
+
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, fmt.Errorf("%w: %s - %s", ErrUnderflow, a, b)
+	}
+	return a - b, nil
+}
+
+// MulDiv returns a * mul / div without overflowing the intermediate product
+func (a Amount) MulDiv(mul uint64, div uint64) (Amount, error) {
+	hi, lo := bits.Mul64(uint64(a), mul)
+	if div == 0 || hi >= div {
+		return 0, fmt.Errorf("%w: %s * %d / %d", ErrOverflow, a, mul, div)
+	}
+	quo, _ := bits.Div64(hi, lo, div)
+	return Amount(quo), nil
+}
+
+// MarshalJSON writes the amount as a number of TOK, e.g. 1.5 for 1500000 units.
+// Data written before amounts had decimal units was in whole TOK, so it keeps its meaning and its hashes.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	amount, err := ParseAmount(string(data))
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// String formats the amount in TOK, e.g. 1.5 for 1500000 units
+func (a Amount) String() string {
+	whole := uint64(a / TOK)
+	frac := uint64(a % TOK)
+	if frac == 0 {
+		return strconv.FormatUint(whole, 10)
+	}
+
+	fracStr := fmt.Sprintf("%0*d", Decimals, frac)
+	return fmt.Sprintf("%d.%s", whole, strings.TrimRight(fracStr, "0"))
+}
+
+// ParseAmount reads an amount in TOK with up to Decimals decimal places, e.g. "1.5"
+func ParseAmount(s string) (Amount, error) {
+	parts := strings.SplitN(s, ".", 2)
+	whole, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount '%s'", s)
+	}
+
+	amount, err := Amount(whole).MulDiv(uint64(TOK), 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) == 1 {
+		return amount, nil
+	}
+
+	fracStr := parts[1]
+	if len(fracStr) == 0 || len(fracStr) > Decimals {
+		return 0, fmt.Errorf("invalid amount '%s', at most %d decimals are allowed", s, Decimals)
+	}
+	fracStr += strings.Repeat("0", Decimals-len(fracStr))
+	frac, err := strconv.ParseUint(fracStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount '%s'", s)
+	}
+
+	return amount.Add(Amount(frac))
+}
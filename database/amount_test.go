@@ -0,0 +1,158 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+const maxAmount = Amount(math.MaxUint64)
+
+func TestAmountAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    Amount
+		want    Amount
+		wantErr error
+	}{
+		{"zero", 0, 0, 0, nil},
+		{"sum", 2 * TOK, 3 * TOK, 5 * TOK, nil},
+		{"up to the max", maxAmount - 1, 1, maxAmount, nil},
+		{"overflow", maxAmount, 1, 0, ErrOverflow},
+		{"overflow of large amounts", maxAmount / 2, maxAmount/2 + 2, 0, ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Add(tt.b)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountSub(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    Amount
+		want    Amount
+		wantErr error
+	}{
+		{"difference", 5 * TOK, 3 * TOK, 2 * TOK, nil},
+		{"down to zero", TOK, TOK, 0, nil},
+		{"underflow", 0, 1, 0, ErrUnderflow},
+		{"underflow from the max", maxAmount - 1, maxAmount, 0, ErrUnderflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Sub(tt.b)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountMulDiv(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        Amount
+		mul, div uint64
+		want     Amount
+		wantErr  error
+	}{
+		{"scale", 3, uint64(TOK), 1, 3 * TOK, nil},
+		{"fraction", 10 * TOK, 1, 4, 2500000, nil},
+		{"rounds down", 10, 1, 3, 3, nil},
+		{"intermediate product above 64 bits", maxAmount, 10, 20, maxAmount / 2, nil},
+		{"result above 64 bits", maxAmount, 2, 1, 0, ErrOverflow},
+		{"division by zero", TOK, 1, 0, 0, ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.MulDiv(tt.mul, tt.div)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1", TOK, false},
+		{"1.5", 1500000, false},
+		{"0.000001", 1, false},
+		{"18446744073709.551615", maxAmount, false},
+		{"18446744073710", 0, true},
+		{"1.0000001", 0, true},
+		{"1.", 0, true},
+		{"-1", 0, true},
+		{"1e6", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseAmount(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		json   string
+	}{
+		{0, "0"},
+		{TOK, "1"},
+		{1500000, "1.5"},
+		{1, "0.000001"},
+		{1000000 * TOK, "1000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			got, err := json.Marshal(tt.amount)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != tt.json {
+				t.Errorf("marshalled to %s, want %s", got, tt.json)
+			}
+
+			var back Amount
+			err = json.Unmarshal(got, &back)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if back != tt.amount {
+				t.Errorf("unmarshalled to %d, want %d", back, tt.amount)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type Hash [32]byte
@@ -40,16 +41,34 @@ type BlockHeader struct {
 	Parent Hash   `json:"parent"` // parent block reference
 	Number uint64 `json:"number"` // block height
 	Time   uint64 `json:"time"`
+	Burned Amount `json:"burned,omitempty"` // TOK burned by the block's burn txs, fees excluded
+	// Gas the block's txs may use in total, set from the consensus params
+	GasLimit uint64 `json:"gas_limit,omitempty"`
 }
 
+// Blocks may be timestamped at most MaxBlockTimeDrift ahead of our clock
+const MaxBlockTimeDrift = time.Minute
+
 type BlockFS struct {
 	Key   Hash  `json:"hash"`
 	Value Block `json:"block"`
+	// Only the header of the block is stored, e.g. when bootstrapped from a snapshot
+	Pruned bool `json:"pruned,omitempty"`
 }
 
-func NewBlock(parent Hash, number uint64, time uint64, txs []Tx) Block {
+func NewBlock(parent Hash, number uint64, time uint64, txs []Tx) (Block, error) {
 	fmt.Printf("Number to be persisted: %d\n", number)
-	return Block{BlockHeader{parent, number, time}, txs}
+	burned := Amount(0)
+	for _, tx := range txs {
+		if tx.isBurn() {
+			var err error
+			burned, err = burned.Add(tx.Value)
+			if err != nil {
+				return Block{}, fmt.Errorf("block burns too much TOK. %s", err.Error())
+			}
+		}
+	}
+	return Block{BlockHeader{Parent: parent, Number: number, Time: time, Burned: burned}, txs}, nil
 }
 
 func (b Block) Hash() (Hash, error) {
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/harshrpg/go-blockchain-tut/vm"
+)
+
+// MaxContractSteps bounds the instructions a single contract call may execute
+const MaxContractSteps uint64 = 100000
+
+// ErrContractFailed marks a call whose execution failed, e.g. reverted or ran out of steps
+var ErrContractFailed = errors.New("contract call failed")
+
+// Contract is bytecode deployed by a contract_deploy tx together with its own storage.
+// Its account holds the TOK sent along with the deploy and call txs.
+type Contract struct {
+	Address Account    `json:"address"`
+	Creator Account    `json:"creator"`
+	Code    string     `json:"code"` // hex encoded bytecode
+	Storage vm.Storage `json:"storage"`
+}
+
+// ContractAddress is the account of the contract deployed by the tx with the given hash
+func ContractAddress(deployTxHash Hash) Account {
+	return NewAccount(fmt.Sprintf("contract:%x", deployTxHash[:20]))
+}
+
+// applyContractDeploy stores the hex bytecode in Data under a new contract account
+func applyContractDeploy(tx Tx, header BlockHeader, s *State) error {
+	if tx.To != "" {
+		return fmt.Errorf("contract deploy must not have a recipient, the contract account is derived from the tx hash")
+	}
+	code, err := hex.DecodeString(tx.Data)
+	if err != nil {
+		return fmt.Errorf("invalid contract bytecode. %s", err.Error())
+	}
+	if len(code) == 0 {
+		return fmt.Errorf("contract bytecode is empty")
+	}
+
+	txHash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	address := ContractAddress(txHash)
+	if _, exists := s.contracts[address]; exists {
+		return fmt.Errorf("contract '%s' already exists", address)
+	}
+
+	if tx.Value > 0 {
+		tx.To = address
+		err = applyTransfer(tx, header, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.contracts[address] = Contract{address, tx.From, tx.Data, make(vm.Storage)}
+	s.emit(Event{Name: EventContractDeployed, From: tx.From, To: address})
+	return nil
+}
+
+// applyContractCall runs the contract in To with the call input encoded in Data
+// as hex 8 byte big endian words. Any TOK sent is credited to the contract.
+// It returns the gas used by the executed instructions, also when the execution failed.
+func applyContractCall(tx Tx, header BlockHeader, s *State) (uint64, error) {
+	c, exists := s.contracts[tx.To]
+	if !exists {
+		return 0, fmt.Errorf("unknown contract '%s'", tx.To)
+	}
+
+	input, err := decodeCallInput(tx.Data)
+	if err != nil {
+		return 0, err
+	}
+	if tx.Value > s.spendable(tx.From, header.Number) {
+		return 0, fmt.Errorf("wrong Tx. Sender '%s' spendable balance is %s TOK. Tx cost is %s TOK", tx.From, s.spendable(tx.From, header.Number), tx.Value)
+	}
+
+	code, err := hex.DecodeString(c.Code)
+	if err != nil {
+		return 0, err
+	}
+	res, err := vm.Execute(code, c.Storage, vm.Call{Input: input, Value: uint64(tx.Value)}, MaxContractSteps)
+	gas := res.Steps * GasPerContractStep
+	if err != nil {
+		return gas, fmt.Errorf("%w: contract '%s': %s", ErrContractFailed, c.Address, err.Error())
+	}
+
+	if tx.Value > 0 {
+		err = applyTransfer(tx, header, s)
+		if err != nil {
+			return gas, err
+		}
+	}
+	c.Storage = res.Storage
+	s.contracts[c.Address] = c
+	for _, words := range res.Logs {
+		s.emit(Event{Name: EventContractLog, From: tx.From, To: c.Address, Data: words})
+	}
+	return gas, nil
+}
+
+func decodeCallInput(data string) ([]uint64, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contract call input. %s", err.Error())
+	}
+	if len(raw)%8 != 0 {
+		return nil, fmt.Errorf("contract call input must be a sequence of 8 byte words, got %d bytes", len(raw))
+	}
+
+	input := make([]uint64, 0, len(raw)/8)
+	for i := 0; i < len(raw); i += 8 {
+		input = append(input, binary.BigEndian.Uint64(raw[i:i+8]))
+	}
+	return input, nil
+}
+
+// Contracts returns every contract deployed on the chain sorted by address
+func (s *State) Contracts() []Contract {
+	contracts := make([]Contract, 0, len(s.contracts))
+	for _, c := range s.contracts {
+		c.Storage = c.Storage.Copy()
+		contracts = append(contracts, c)
+	}
+	sort.Slice(contracts, func(i, j int) bool {
+		return contracts[i].Address < contracts[j].Address
+	})
+	return contracts
+}
+
+func copyContracts(contracts map[Account]Contract) map[Account]Contract {
+	c := make(map[Account]Contract)
+	for address, contract := range contracts {
+		contract.Storage = contract.Storage.Copy()
+		c[address] = contract
+	}
+	return c
+}
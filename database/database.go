@@ -1,36 +1,52 @@
 package database
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 )
 
-func GetBlocksAfter(blockHash Hash, dataDir string) ([]Block, error) {
+var ErrBlockPruned = errors.New("block body is not stored by this node")
+var ErrUnknownBlock = errors.New("unknown block")
+
+// ErrInvalidBlock marks a block that failed validation, unlike errors writing a valid block to disk
+var ErrInvalidBlock = errors.New("invalid block")
+
+// GetBlocksAfter returns at most limit blocks following the given one, all of them if limit is 0.
+// It also reports whether more blocks follow the returned ones.
+func GetBlocksAfter(blockHash Hash, limit int, dataDir string) ([]Block, bool, error) {
 	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	defer f.Close()
 
 	blocks := make([]Block, 0)
 	shouldStartCollecing := false
 	if reflect.DeepEqual(blockHash, Hash{}) {
 		shouldStartCollecing = true
 	}
-	scanner := bufio.NewScanner(f)
+	scanner := newDbScanner(f)
 	for scanner.Scan() {
 		if err := scanner.Err(); err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		var blockFs BlockFS
 		err = json.Unmarshal(scanner.Bytes(), &blockFs)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		if shouldStartCollecing {
+			if limit > 0 && len(blocks) == limit {
+				return blocks, true, nil
+			}
+			if blockFs.Pruned {
+				return nil, false, fmt.Errorf("%w: block #%d '%x'", ErrBlockPruned, blockFs.Value.Header.Number, blockFs.Key)
+			}
 			blocks = append(blocks, blockFs.Value)
 			continue
 		}
@@ -39,6 +55,127 @@ func GetBlocksAfter(blockHash Hash, dataDir string) ([]Block, error) {
 			shouldStartCollecing = true
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if !shouldStartCollecing {
+		return nil, false, fmt.Errorf("%w '%x'", ErrUnknownBlock, blockHash)
+	}
+	return blocks, false, nil
+}
+
+// GetHeadersUpTo returns the header chain from genesis up to and including the given block
+func GetHeadersUpTo(blockHash Hash, dataDir string) ([]BlockHeaderFS, error) {
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	headers := make([]BlockHeaderFS, 0)
+	scanner := newDbScanner(f)
+	for scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		var blockFs BlockFS
+		err = json.Unmarshal(scanner.Bytes(), &blockFs)
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append(headers, BlockHeaderFS{blockFs.Key, blockFs.Value.Header})
+		if blockFs.Key == blockHash {
+			return headers, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("block '%x' not found", blockHash)
+}
+
+// scanBlocksDb calls fn for each entry of the block db until it returns false
+func scanBlocksDb(dataDir string, fn func(blockFs BlockFS) (bool, error)) error {
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := newDbScanner(f)
+	for scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		var blockFs BlockFS
+		err = json.Unmarshal(scanner.Bytes(), &blockFs)
+		if err != nil {
+			return err
+		}
+
+		next, err := fn(blockFs)
+		if err != nil {
+			return err
+		}
+		if !next {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// GetHeadersAfter returns at most limit headers following the given block, all of them if limit is 0.
+// Headers of pruned blocks are included. It also reports whether more headers follow.
+func GetHeadersAfter(blockHash Hash, limit int, dataDir string) ([]BlockHeaderFS, bool, error) {
+	headers := make([]BlockHeaderFS, 0)
+	collecting := blockHash.IsEmpty()
+	more := false
+
+	err := scanBlocksDb(dataDir, func(blockFs BlockFS) (bool, error) {
+		if !collecting {
+			collecting = blockFs.Key == blockHash
+			return true, nil
+		}
+		if limit > 0 && len(headers) == limit {
+			more = true
+			return false, nil
+		}
+		headers = append(headers, BlockHeaderFS{blockFs.Key, blockFs.Value.Header})
+		return true, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !collecting {
+		return nil, false, fmt.Errorf("%w '%x'", ErrUnknownBlock, blockHash)
+	}
+	return headers, more, nil
+}
 
+// GetBlocksByNumber returns the stored blocks numbered from to to, both included
+func GetBlocksByNumber(from uint64, to uint64, dataDir string) ([]Block, error) {
+	blocks := make([]Block, 0)
+	err := scanBlocksDb(dataDir, func(blockFs BlockFS) (bool, error) {
+		number := blockFs.Value.Header.Number
+		if number < from {
+			return true, nil
+		}
+		if number > to {
+			return false, nil
+		}
+		if blockFs.Pruned {
+			return false, fmt.Errorf("%w: block #%d '%x'", ErrBlockPruned, number, blockFs.Key)
+		}
+		blocks = append(blocks, blockFs.Value)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return blocks, nil
 }
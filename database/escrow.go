@@ -0,0 +1,155 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Escrow holds TOK locked by an escrow_lock tx until the recipient claims it by revealing
+// the preimage of HashLock, or the sender takes it back once the Timeout height is reached
+type Escrow struct {
+	ID       Hash    `json:"id"` // hash of the escrow_lock tx
+	From     Account `json:"from"`
+	To       Account `json:"to"`
+	Value    Amount  `json:"value"`
+	HashLock Hash    `json:"hash_lock"`
+	Timeout  uint64  `json:"timeout"`
+}
+
+// EscrowTx carries the escrow fields of escrow_lock, escrow_claim and escrow_refund txs
+type EscrowTx struct {
+	HashLock Hash   `json:"hash_lock"`          // lock: sha256 of the secret preimage
+	Timeout  uint64 `json:"timeout,omitempty"`  // lock: refundable from this block height
+	ID       Hash   `json:"id"`                 // claim and refund: the escrow
+	Preimage string `json:"preimage,omitempty"` // claim: hex encoded secret
+}
+
+func applyEscrowLock(tx Tx, header BlockHeader, s *State) error {
+	if tx.Escrow == nil {
+		return fmt.Errorf("escrow tx is missing its escrow fields")
+	}
+	if tx.Asset != "" {
+		return fmt.Errorf("only TOK can be escrowed")
+	}
+	if tx.Escrow.Timeout <= header.Number {
+		return fmt.Errorf("escrow timeout %d must be after block #%d", tx.Escrow.Timeout, header.Number)
+	}
+	if tx.Value > s.spendable(tx.From, header.Number) {
+		return fmt.Errorf("wrong Tx. Sender '%s' spendable balance is %s TOK. Escrow is %s TOK", tx.From, s.spendable(tx.From, header.Number), tx.Value)
+	}
+
+	id, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	if _, exists := s.escrows[id]; exists {
+		return fmt.Errorf("escrow '%x' already exists", id)
+	}
+
+	s.Balances[tx.From] -= tx.Value
+	s.escrows[id] = Escrow{id, tx.From, tx.To, tx.Value, tx.Escrow.HashLock, tx.Escrow.Timeout}
+	s.emit(Event{Name: EventEscrowLocked, From: tx.From, To: tx.To, Value: tx.Value})
+	return nil
+}
+
+// applyEscrowClaim pays the escrow to its recipient if the preimage matches before the timeout
+func applyEscrowClaim(tx Tx, header BlockHeader, s *State) error {
+	e, err := escrowFor(tx, s)
+	if err != nil {
+		return err
+	}
+	if tx.From != e.To {
+		return fmt.Errorf("only '%s' can claim escrow '%x'", e.To, e.ID)
+	}
+	if header.Number >= e.Timeout {
+		return fmt.Errorf("escrow '%x' timed out at block #%d", e.ID, e.Timeout)
+	}
+
+	preimage, err := hex.DecodeString(tx.Escrow.Preimage)
+	if err != nil {
+		return fmt.Errorf("invalid preimage. %s", err.Error())
+	}
+	if Hash(sha256.Sum256(preimage)) != e.HashLock {
+		return fmt.Errorf("preimage does not match the hash lock of escrow '%x'", e.ID)
+	}
+
+	return releaseEscrow(e, e.To, s)
+}
+
+// applyEscrowRefund returns the escrow to its sender once the timeout is reached
+func applyEscrowRefund(tx Tx, header BlockHeader, s *State) error {
+	e, err := escrowFor(tx, s)
+	if err != nil {
+		return err
+	}
+	if tx.From != e.From {
+		return fmt.Errorf("only '%s' can refund escrow '%x'", e.From, e.ID)
+	}
+	if header.Number < e.Timeout {
+		return fmt.Errorf("escrow '%x' can't be refunded before block #%d", e.ID, e.Timeout)
+	}
+
+	return releaseEscrow(e, e.From, s)
+}
+
+func escrowFor(tx Tx, s *State) (Escrow, error) {
+	if tx.Escrow == nil {
+		return Escrow{}, fmt.Errorf("escrow tx is missing its escrow fields")
+	}
+	if tx.Value != 0 || tx.Asset != "" {
+		return Escrow{}, fmt.Errorf("escrow claims and refunds must not carry a value")
+	}
+
+	e, exists := s.escrows[tx.Escrow.ID]
+	if !exists {
+		return Escrow{}, fmt.Errorf("unknown escrow '%x'", tx.Escrow.ID)
+	}
+	return e, nil
+}
+
+func releaseEscrow(e Escrow, to Account, s *State) error {
+	balance, err := s.Balances[to].Add(e.Value)
+	if err != nil {
+		return err
+	}
+	s.Balances[to] = balance
+	delete(s.escrows, e.ID)
+	s.emit(Event{Name: EventEscrowReleased, From: e.From, To: to, Value: e.Value})
+	return nil
+}
+
+// Escrows returns every escrow that was neither claimed nor refunded yet sorted by id
+func (s *State) Escrows() []Escrow {
+	escrows := make([]Escrow, 0, len(s.escrows))
+	for _, e := range s.escrows {
+		escrows = append(escrows, e)
+	}
+	sort.Slice(escrows, func(i, j int) bool {
+		return bytes.Compare(escrows[i].ID[:], escrows[j].ID[:]) < 0
+	})
+	return escrows
+}
+
+// totalEscrowed is the amount of TOK locked in escrows
+func (s *State) totalEscrowed() (Amount, error) {
+	total := Amount(0)
+	for _, e := range s.escrows {
+		var err error
+		total, err = total.Add(e.Value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func copyEscrows(escrows map[Hash]Escrow) map[Hash]Escrow {
+	c := make(map[Hash]Escrow)
+	for id, e := range escrows {
+		c[id] = e
+	}
+	return c
+}
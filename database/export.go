@@ -0,0 +1,124 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ChainExportHeader is the first line of a chain export file.
+// It ties the exported blocks to the chain they were taken from.
+type ChainExportHeader struct {
+	ChainID     string `json:"chain_id"`
+	GenesisHash Hash   `json:"genesis_hash"`
+	From        uint64 `json:"from"`
+	To          uint64 `json:"to"`
+}
+
+// ExportBlocks writes the blocks numbered from..to (inclusive) to w, one BlockFS per line after the header
+func ExportBlocks(dataDir string, header ChainExportHeader, w io.Writer) (int, error) {
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(append(headerJson, '\n'))
+	if err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	scanner := newDbScanner(f)
+	for scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+
+		var blockFs BlockFS
+		err = json.Unmarshal(scanner.Bytes(), &blockFs)
+		if err != nil {
+			return 0, err
+		}
+
+		number := blockFs.Value.Header.Number
+		if number < header.From || number > header.To {
+			continue
+		}
+		if blockFs.Pruned {
+			return 0, fmt.Errorf("%w: block #%d '%x'", ErrBlockPruned, number, blockFs.Key)
+		}
+
+		_, err = w.Write(append(scanner.Bytes(), '\n'))
+		if err != nil {
+			return 0, err
+		}
+		exported++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if uint64(exported) != header.To-header.From+1 {
+		return 0, fmt.Errorf("only %d of blocks #%d to #%d are stored", exported, header.From, header.To)
+	}
+
+	return exported, nil
+}
+
+// ReadChainExport reads an export file written by ExportBlocks. It checks every block matches its
+// recorded hash and that the blocks are exactly the From..To range announced in the header.
+func ReadChainExport(r io.Reader) (ChainExportHeader, []Block, error) {
+	scanner := newDbScanner(r)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return ChainExportHeader{}, nil, err
+		}
+		return ChainExportHeader{}, nil, fmt.Errorf("export file is empty")
+	}
+
+	var header ChainExportHeader
+	err := json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil {
+		return ChainExportHeader{}, nil, fmt.Errorf("invalid export header. %s", err.Error())
+	}
+	if header.From > header.To {
+		return ChainExportHeader{}, nil, fmt.Errorf("export header range #%d to #%d is empty", header.From, header.To)
+	}
+
+	blocks := make([]Block, 0)
+	for scanner.Scan() {
+		var blockFs BlockFS
+		err = json.Unmarshal(scanner.Bytes(), &blockFs)
+		if err != nil {
+			return ChainExportHeader{}, nil, err
+		}
+
+		blockHash, err := blockFs.Value.Hash()
+		if err != nil {
+			return ChainExportHeader{}, nil, err
+		}
+		if blockHash != blockFs.Key {
+			return ChainExportHeader{}, nil, fmt.Errorf("block #%d hashes to '%x' not '%x'", blockFs.Value.Header.Number, blockHash, blockFs.Key)
+		}
+		expected := header.From + uint64(len(blocks))
+		if blockFs.Value.Header.Number != expected {
+			return ChainExportHeader{}, nil, fmt.Errorf("expected block #%d in the export, got block #%d", expected, blockFs.Value.Header.Number)
+		}
+
+		blocks = append(blocks, blockFs.Value)
+	}
+	if err := scanner.Err(); err != nil {
+		return ChainExportHeader{}, nil, err
+	}
+	if uint64(len(blocks)) != header.To-header.From+1 {
+		return ChainExportHeader{}, nil, fmt.Errorf("export header announces blocks #%d to #%d but the file has %d blocks", header.From, header.To, len(blocks))
+	}
+
+	return header, blocks, nil
+}
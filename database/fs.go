@@ -1,11 +1,24 @@
 package database
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
+// Longest line of a db file, blocks and receipts can be larger than the default 64KB scanner limit
+const maxDbLineSize = 64 * 1024 * 1024
+
+// newDbScanner reads a db file one line at a time
+func newDbScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxDbLineSize)
+	return scanner
+}
+
 func getDatabaseDirPath(dataDir string) string {
 	return filepath.Join(dataDir, "database")
 }
@@ -18,16 +31,68 @@ func getBlocksDbFilePath(dataDir string) string {
 	return filepath.Join(getDatabaseDirPath(dataDir), "block.db")
 }
 
+func getReceiptsDbFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "receipts.db")
+}
+
+func getSnapshotFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "snapshot.json")
+}
+
+// getForkDataDirPath is the scratch data dir a peer's fork is validated in before switching to it
+func getForkDataDirPath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "fork")
+}
+
 func initDataDirIfNotExists(dataDir string) error {
 	if fileExist(getGenesisJsonFilePath(dataDir)) {
 		return nil
 	}
 
+	return initDataDir(dataDir, []byte(genesisJson))
+}
+
+// InitDataDir installs the genesis file at genesisPath into a fresh data dir.
+// An already initialised data dir is only accepted if its genesis is the same, however it is formatted.
+func InitDataDir(dataDir string, genesisPath string) (Hash, error) {
+	content, err := ioutil.ReadFile(genesisPath)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	gen, err := parseGenesis(content)
+	if err != nil {
+		return Hash{}, err
+	}
+	genHash, err := gen.Hash()
+	if err != nil {
+		return Hash{}, err
+	}
+
+	if fileExist(getGenesisJsonFilePath(dataDir)) {
+		existing, err := loadGenesis(getGenesisJsonFilePath(dataDir))
+		if err != nil {
+			return Hash{}, err
+		}
+		existingHash, err := existing.Hash()
+		if err != nil {
+			return Hash{}, err
+		}
+		if existingHash != genHash {
+			return Hash{}, fmt.Errorf("data dir '%s' was initialised with genesis '%x', not '%x'", dataDir, existingHash, genHash)
+		}
+		return genHash, nil
+	}
+
+	return genHash, initDataDir(dataDir, content)
+}
+
+func initDataDir(dataDir string, genesisContent []byte) error {
 	if err := os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm); err != nil {
 		return err
 	}
 
-	if err := writeGenesisToDisk(getGenesisJsonFilePath(dataDir)); err != nil {
+	if err := writeGenesisToDisk(getGenesisJsonFilePath(dataDir), genesisContent); err != nil {
 		return err
 	}
 
@@ -0,0 +1,54 @@
+package database
+
+import "fmt"
+
+// Gas measures the work needed to validate and apply a tx. Every tx pays GasTx,
+// GasPerDataByte for each byte of Data and the extra cost of its kind.
+// Contract calls also pay GasPerContractStep for each instruction executed.
+const GasTx uint64 = 1000
+const GasPerDataByte uint64 = 16
+const GasPerContractStep uint64 = 10
+
+var txKindGas = map[string]uint64{
+	TxKindMultisigCreate: 5000,
+	TxKindTokenCreate:    20000,
+	TxKindApprove:        1000,
+	TxKindTransferFrom:   1000,
+	TxKindEscrowLock:     2000,
+	TxKindEscrowClaim:    2000,
+	TxKindEscrowRefund:   1000,
+	TxKindContractDeploy: 30000,
+	TxKindContractCall:   2000,
+}
+
+// IntrinsicGas is the gas a tx costs before any contract code runs
+func (t Tx) IntrinsicGas() uint64 {
+	if t.isReward() {
+		return 0
+	}
+	return GasTx + txKindGas[t.Kind] + uint64(len(t.Data))*GasPerDataByte
+}
+
+func gasUsed(receipts []Receipt) uint64 {
+	total := uint64(0)
+	for _, r := range receipts {
+		total += r.GasUsed
+	}
+	return total
+}
+
+// checkBlockGas validates the block gas limit is the consensus one and was respected
+func checkBlockGas(b Block, receipts []Receipt, s *State) error {
+	if b.Header.GasLimit != s.consensus.BlockGasLimit {
+		return fmt.Errorf("block #%d gas limit is %d, the consensus limit is %d", b.Header.Number, b.Header.GasLimit, s.consensus.BlockGasLimit)
+	}
+	if used := gasUsed(receipts); b.Header.GasLimit > 0 && used > b.Header.GasLimit {
+		return fmt.Errorf("block #%d used %d gas, the limit is %d", b.Header.Number, used, b.Header.GasLimit)
+	}
+	return nil
+}
+
+// BlockGasLimit is the gas every block may use, 0 means unlimited
+func (s *State) BlockGasLimit() uint64 {
+	return s.consensus.BlockGasLimit
+}
@@ -1,8 +1,11 @@
 package database
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"time"
 )
 
 var genesisJson = `
@@ -14,8 +17,35 @@ var genesisJson = `
     }
 }`
 
+// genesis is also the canonical form hashed to identify the chain. Optional fields are omitted
+// when absent, so adding a field keeps the hash of every genesis not using it.
 type genesis struct {
-	Balances map[Account]uint `json:"balances"`
+	Time     time.Time          `json:"genesis_time"`
+	ChainID  string             `json:"chain_id"`
+	Balances map[Account]Amount `json:"balances"`
+	// Part of an account's balance can be locked until given block heights
+	Vesting map[Account]Vesting `json:"vesting,omitempty"`
+	// Accounts only spendable with M-of-N signatures
+	Multisig map[Account]MultisigAccount `json:"multisig,omitempty"`
+	// Rewards minting past this much TOK are rejected, 0 means uncapped
+	MaxSupply Amount           `json:"max_supply,omitempty"`
+	Consensus *ConsensusParams `json:"consensus,omitempty"`
+}
+
+// ConsensusParams are the rules every node of the chain validates blocks against
+type ConsensusParams struct {
+	// Maximum number of transactions in a block, 0 means unlimited
+	MaxBlockTxs uint64 `json:"max_block_txs,omitempty"`
+	// Maximum gas used by the txs of a block, 0 means unlimited
+	BlockGasLimit uint64 `json:"block_gas_limit,omitempty"`
+}
+
+// consensusParams returns the consensus params of the genesis, the zero params mean no limits
+func (g genesis) consensusParams() ConsensusParams {
+	if g.Consensus == nil {
+		return ConsensusParams{}
+	}
+	return *g.Consensus
 }
 
 func loadGenesis(path string) (genesis, error) {
@@ -24,14 +54,77 @@ func loadGenesis(path string) (genesis, error) {
 		return genesis{}, err
 	}
 
+	return parseGenesis(content)
+}
+
+func parseGenesis(content []byte) (genesis, error) {
 	var loadedGenesis genesis
-	err = json.Unmarshal(content, &loadedGenesis)
+	err := json.Unmarshal(content, &loadedGenesis)
 	if err != nil {
 		return genesis{}, err
 	}
+	// No params and empty params are the same chain
+	if loadedGenesis.Consensus != nil && *loadedGenesis.Consensus == (ConsensusParams{}) {
+		loadedGenesis.Consensus = nil
+	}
+
+	err = loadedGenesis.validate()
+	if err != nil {
+		return genesis{}, fmt.Errorf("invalid genesis. %s", err.Error())
+	}
 	return loadedGenesis, nil
 }
 
-func writeGenesisToDisk(path string) error {
-	return ioutil.WriteFile(path, []byte(genesisJson), 0644)
+func (g genesis) validate() error {
+	if g.ChainID == "" {
+		return fmt.Errorf("chain_id is required")
+	}
+	if g.Time.IsZero() {
+		return fmt.Errorf("genesis_time is required")
+	}
+	if len(g.Balances) == 0 {
+		return fmt.Errorf("at least one account balance is required")
+	}
+	total := Amount(0)
+	for account, balance := range g.Balances {
+		if account == "" {
+			return fmt.Errorf("account names must not be empty")
+		}
+		var err error
+		total, err = total.Add(balance)
+		if err != nil {
+			return fmt.Errorf("total genesis balance %s", err.Error())
+		}
+	}
+	if g.MaxSupply > 0 && total > g.MaxSupply {
+		return fmt.Errorf("genesis balances of %s TOK exceed the max supply of %s TOK", total, g.MaxSupply)
+	}
+	for account, v := range g.Vesting {
+		if v.Locked > g.Balances[account] {
+			return fmt.Errorf("account '%s' locks %s TOK but only has %s TOK", account, v.Locked, g.Balances[account])
+		}
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("account '%s': %s", account, err.Error())
+		}
+	}
+	for account, m := range g.Multisig {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("multisig account '%s': %s", account, err.Error())
+		}
+	}
+	return nil
+}
+
+// The genesis hash identifies the chain, nodes with a different genesis are on another chain.
+// The parsed genesis is hashed, so reformatting the file keeps the same chain.
+func (g genesis) Hash() (Hash, error) {
+	genesisJson, err := json.Marshal(g)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(genesisJson), nil
+}
+
+func writeGenesisToDisk(path string, content []byte) error {
+	return ioutil.WriteFile(path, content, 0644)
 }
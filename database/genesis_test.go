@@ -0,0 +1,44 @@
+package database
+
+import "testing"
+
+func TestGenesisHashIgnoresAbsentFields(t *testing.T) {
+	base := `{"genesis_time": "2021-04-04T00:00:00Z", "chain_id": "test", "balances": {"owner": 10}`
+	tests := []struct {
+		name    string
+		content string
+		same    bool
+	}{
+		{"reformatted", "{\n  \"chain_id\": \"test\",\n  \"genesis_time\": \"2021-04-04T00:00:00Z\",\n  \"balances\": {\"owner\": 10.0}\n}", true},
+		{"empty vesting and multisig", base + `, "vesting": {}, "multisig": {}}`, true},
+		{"zero max supply", base + `, "max_supply": 0}`, true},
+		{"empty consensus", base + `, "consensus": {}}`, true},
+		{"zero consensus params", base + `, "consensus": {"max_block_txs": 0}}`, true},
+		{"max supply", base + `, "max_supply": 100}`, false},
+		{"consensus param", base + `, "consensus": {"max_block_txs": 10}}`, false},
+		{"balance", `{"genesis_time": "2021-04-04T00:00:00Z", "chain_id": "test", "balances": {"owner": 11}}`, false},
+	}
+
+	want := genesisHash(t, base+"}")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := genesisHash(t, tt.content)
+			if (got == want) != tt.same {
+				t.Errorf("got hash '%x', base hash '%x', want same %t", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func genesisHash(t *testing.T, content string) Hash {
+	t.Helper()
+	gen, err := parseGenesis([]byte(content))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hash, err := gen.Hash()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return hash
+}
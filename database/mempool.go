@@ -0,0 +1,204 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// The mempool keeps at most MaxMempoolTxs txs. Once full, the oldest tx scheduled for a later
+// block makes room for a new tx, if there is none the new tx is rejected.
+const MaxMempoolTxs = 5000
+
+var ErrMempoolFull = errors.New("mempool is full")
+
+// AddTx validates the tx against the next block and keeps it in the mempool until it's included.
+// Txs that are not valid yet wait in the mempool once the checks not depending on the state
+// pass, expired or unaffordable txs are rejected.
+func (s *State) AddTx(tx Tx, next BlockHeader) error {
+	txHash, err := tx.Hash()
+	if err != nil {
+		return err
+	}
+	if s.IsPending(txHash) {
+		return fmt.Errorf("tx '%x' is already pending", txHash)
+	}
+
+	validErr := tx.checkValidAt(next)
+	if errors.Is(validErr, ErrTxNotYetValid) {
+		err = s.checkScheduledTx(tx)
+		if err != nil {
+			return err
+		}
+		err = s.makeMempoolRoom(next)
+		if err != nil {
+			return err
+		}
+		log.Printf("Tx '%x' is scheduled for later. %s\n", txHash, validErr)
+		s.addToMempool(txHash, tx)
+		return nil
+	}
+	if validErr != nil {
+		return validErr
+	}
+
+	pendingState := s.copy()
+	receipt, err := applyTx(tx, next, &pendingState)
+	if err != nil {
+		return err
+	}
+	if s.consensus.BlockGasLimit > 0 && receipt.GasUsed > s.consensus.BlockGasLimit {
+		return fmt.Errorf("tx needs %d gas, more than the block gas limit of %d", receipt.GasUsed, s.consensus.BlockGasLimit)
+	}
+
+	err = s.makeMempoolRoom(next)
+	if err != nil {
+		return err
+	}
+	s.addToMempool(txHash, tx)
+	return nil
+}
+
+// checkScheduledTx runs the checks of a tx that don't need the state it will be applied to
+func (s *State) checkScheduledTx(tx Tx) error {
+	switch tx.Kind {
+	case "", TxKindTokenCreate:
+	case TxKindMultisigCreate, TxKindBurn, TxKindApprove, TxKindTransferFrom, TxKindContractDeploy, TxKindContractCall:
+		if tx.Asset != "" {
+			return fmt.Errorf("tx kind '%s' only moves TOK", tx.Kind)
+		}
+	case TxKindEscrowLock, TxKindEscrowClaim, TxKindEscrowRefund:
+		if tx.Asset != "" {
+			return fmt.Errorf("tx kind '%s' only moves TOK", tx.Kind)
+		}
+		if tx.Escrow == nil {
+			return fmt.Errorf("escrow tx is missing its escrow fields")
+		}
+	default:
+		return fmt.Errorf("unknown tx kind '%s'", tx.Kind)
+	}
+	if tx.Asset == NativeAsset {
+		return fmt.Errorf("TOK is moved with an empty asset, not '%s'", NativeAsset)
+	}
+
+	if m, ok := s.multisig[tx.From]; ok {
+		return m.verifySignatures(tx, s.chainID)
+	}
+	return nil
+}
+
+// makeMempoolRoom evicts the oldest tx not valid in the next block if the mempool is full
+func (s *State) makeMempoolRoom(next BlockHeader) error {
+	if len(s.txMempool) < MaxMempoolTxs {
+		return nil
+	}
+
+	for i, tx := range s.txMempool {
+		if !errors.Is(tx.checkValidAt(next), ErrTxNotYetValid) {
+			continue
+		}
+		hash, err := tx.Hash()
+		if err != nil {
+			return err
+		}
+		log.Printf("Mempool is full, evicting tx '%x' scheduled for later\n", hash)
+		s.txMempool = append(s.txMempool[:i:i], s.txMempool[i+1:]...)
+		delete(s.mempoolHashes, hash)
+		return nil
+	}
+	return fmt.Errorf("%w with %d txs", ErrMempoolFull, len(s.txMempool))
+}
+
+func (s *State) addToMempool(txHash Hash, tx Tx) {
+	s.txMempool = append(s.txMempool, tx)
+	s.mempoolHashes[txHash] = true
+}
+
+// setMempool replaces the mempool and rebuilds its hash index
+func (s *State) setMempool(txs []Tx) {
+	s.txMempool = txs
+	s.mempoolHashes = make(map[Hash]bool, len(txs))
+	for _, tx := range txs {
+		hash, err := tx.Hash()
+		if err == nil {
+			s.mempoolHashes[hash] = true
+		}
+	}
+}
+
+// PendingTxs returns a copy of the mempool
+func (s *State) PendingTxs() []Tx {
+	txs := make([]Tx, len(s.txMempool))
+	copy(txs, s.txMempool)
+	return txs
+}
+
+func (s *State) IsPending(txHash Hash) bool {
+	return s.mempoolHashes[txHash]
+}
+
+// NextBlockTxs picks the mempool txs that can be included in a block with this header.
+// Txs that are no longer valid are dropped from the mempool. Once the next tx would
+// exceed the block gas limit the remaining txs wait for a later block.
+func (s *State) NextBlockTxs(next BlockHeader) []Tx {
+	pendingState := s.copy()
+	txs := make([]Tx, 0)
+	mempool := make([]Tx, 0, len(s.txMempool))
+	gas := uint64(0)
+	full := false
+
+	for _, tx := range s.txMempool {
+		if full || s.consensus.MaxBlockTxs > 0 && uint64(len(txs)) >= s.consensus.MaxBlockTxs {
+			mempool = append(mempool, tx)
+			continue
+		}
+
+		err := tx.checkValidAt(next)
+		if errors.Is(err, ErrTxNotYetValid) {
+			mempool = append(mempool, tx)
+			continue
+		}
+		var receipt Receipt
+		if err == nil {
+			receipt, err = applyTx(tx, next, &pendingState)
+		}
+		if err != nil {
+			log.Printf("Dropping tx from mempool. Err: %s\n", err)
+			continue
+		}
+		if next.GasLimit > 0 && gas+receipt.GasUsed > next.GasLimit {
+			log.Printf("Block gas limit of %d reached, leaving the remaining txs in the mempool\n", next.GasLimit)
+			full = true
+			mempool = append(mempool, tx)
+			continue
+		}
+		gas += receipt.GasUsed
+
+		txs = append(txs, tx)
+		mempool = append(mempool, tx)
+	}
+
+	s.setMempool(mempool)
+	return txs
+}
+
+// removeFromMempool drops the txs that were included in a block
+func (s *State) removeFromMempool(b Block) {
+	included := make(map[Hash]bool)
+	for _, tx := range b.TXs {
+		hash, err := tx.Hash()
+		if err == nil {
+			included[hash] = true
+		}
+	}
+
+	mempool := make([]Tx, 0, len(s.txMempool))
+	for _, tx := range s.txMempool {
+		hash, err := tx.Hash()
+		if err == nil && included[hash] {
+			continue
+		}
+		mempool = append(mempool, tx)
+	}
+	s.setMempool(mempool)
+}
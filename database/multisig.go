@@ -0,0 +1,136 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+)
+
+// MultisigAccount is controlled by Threshold out of the ed25519 public Keys.
+// The nonce of every outgoing tx must be one above the account's Nonce so signed txs can't be replayed.
+type MultisigAccount struct {
+	Threshold uint     `json:"threshold"`
+	Keys      []string `json:"keys"` // hex encoded ed25519 public keys
+	Nonce     uint64   `json:"nonce"`
+}
+
+type Signature struct {
+	PubKey string `json:"pub_key"` // hex encoded ed25519 public key
+	Sig    string `json:"sig"`     // hex encoded signature of the tx SigningHash
+}
+
+func (m MultisigAccount) validate() error {
+	if m.Threshold == 0 || m.Threshold > uint(len(m.Keys)) {
+		return fmt.Errorf("threshold must be between 1 and %d, not %d", len(m.Keys), m.Threshold)
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range m.Keys {
+		pubKey, err := hex.DecodeString(key)
+		if err != nil || len(pubKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid public key '%s'", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("duplicate public key '%s'", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// verifySignatures checks the tx is signed for this chain by at least Threshold distinct keys of the account
+func (m MultisigAccount) verifySignatures(tx Tx, chainID string) error {
+	signingHash, err := tx.SigningHash(chainID)
+	if err != nil {
+		return err
+	}
+
+	isKey := make(map[string]bool)
+	for _, key := range m.Keys {
+		isKey[key] = true
+	}
+
+	signed := make(map[string]bool)
+	for _, s := range tx.Signatures {
+		if !isKey[s.PubKey] || signed[s.PubKey] {
+			continue
+		}
+		pubKey, err := hex.DecodeString(s.PubKey)
+		if err != nil {
+			continue
+		}
+		sig, err := hex.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(ed25519.PublicKey(pubKey), signingHash[:], sig) {
+			signed[s.PubKey] = true
+		}
+	}
+
+	if uint(len(signed)) < m.Threshold {
+		return fmt.Errorf("tx has %d valid signatures, %d required", len(signed), m.Threshold)
+	}
+	return nil
+}
+
+// SignTx returns the signature of the tx on the given chain by the given ed25519 private key
+func SignTx(tx Tx, chainID string, privKey ed25519.PrivateKey) (Signature, error) {
+	signingHash, err := tx.SigningHash(chainID)
+	if err != nil {
+		return Signature{}, err
+	}
+
+	return Signature{
+		PubKey: hex.EncodeToString(privKey.Public().(ed25519.PublicKey)),
+		Sig:    hex.EncodeToString(ed25519.Sign(privKey, signingHash[:])),
+	}, nil
+}
+
+func (s *State) MultisigAccount(account Account) (MultisigAccount, bool) {
+	m, ok := s.multisig[account]
+	return m, ok
+}
+
+// applyMultisigCreate turns the tx recipient into a new multisig account funded with the tx value
+func applyMultisigCreate(tx Tx, s *State) error {
+	if tx.Multisig == nil {
+		return fmt.Errorf("multisig tx is missing the account policy")
+	}
+	if _, exists := s.Balances[tx.To]; exists {
+		return fmt.Errorf("account '%s' already exists", tx.To)
+	}
+	if _, exists := s.multisig[tx.To]; exists {
+		return fmt.Errorf("account '%s' already exists", tx.To)
+	}
+
+	policy := MultisigAccount{Threshold: tx.Multisig.Threshold, Keys: tx.Multisig.Keys}
+	err := policy.validate()
+	if err != nil {
+		return err
+	}
+
+	s.multisig[tx.To] = policy
+	s.emit(Event{Name: EventMultisigCreated, From: tx.From, To: tx.To})
+	return nil
+}
+
+// authorizeMultisig checks the signatures and nonce of txs sent from a multisig account
+func authorizeMultisig(tx Tx, s *State) error {
+	m, ok := s.multisig[tx.From]
+	if !ok {
+		return nil
+	}
+
+	if tx.Nonce != m.Nonce+1 {
+		return fmt.Errorf("multisig account '%s' expects nonce %d, not %d", tx.From, m.Nonce+1, tx.Nonce)
+	}
+	err := m.verifySignatures(tx, s.chainID)
+	if err != nil {
+		return err
+	}
+
+	m.Nonce = tx.Nonce
+	s.multisig[tx.From] = m
+	return nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// Prune discards the bodies and receipts of blocks more than depth blocks behind the latest one.
+// Only blocks covered by the latest snapshot are pruned so the state can still be
+// rebuilt on restart. Headers are always kept.
+func (s *State) Prune(depth uint64) error {
+	snap, err := loadSnapshot(getSnapshotFilePath(s.dataDir))
+	if err != nil {
+		return err
+	}
+
+	latestNumber := s.latestBlock.Header.Number
+	if latestNumber < depth {
+		return nil
+	}
+	pruneUpTo := latestNumber - depth
+	if snap.Height < pruneUpTo {
+		pruneUpTo = snap.Height
+	}
+
+	tmpPath := getBlocksDbFilePath(s.dataDir) + ".tmp"
+	prunedCount, err := writePrunedBlocksDb(s.dataDir, tmpPath, pruneUpTo)
+	if err != nil || prunedCount == 0 {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	log.Printf("Pruning %d block bodies before block #%d\n", prunedCount, pruneUpTo)
+	err = s.dbFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	renameErr := os.Rename(tmpPath, getBlocksDbFilePath(s.dataDir))
+	if renameErr != nil {
+		os.Remove(tmpPath)
+	}
+
+	// Reopened even if the rename failed so new blocks can still be added
+	s.dbFile, err = os.OpenFile(getBlocksDbFilePath(s.dataDir), os.O_APPEND|os.O_RDWR, 0600)
+	if renameErr != nil {
+		return renameErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.rewriteReceipts(func(r Receipt) bool {
+		return r.BlockNumber >= pruneUpTo
+	})
+}
+
+// writePrunedBlocksDb copies the block db to path without the bodies of blocks before pruneUpTo
+// and returns how many bodies were dropped
+func writePrunedBlocksDb(dataDir string, path string, pruneUpTo uint64) (int, error) {
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	tmp, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer tmp.Close()
+
+	prunedCount := 0
+	scanner := newDbScanner(f)
+	for scanner.Scan() {
+		var blockFs BlockFS
+		err = json.Unmarshal(scanner.Bytes(), &blockFs)
+		if err != nil {
+			return 0, err
+		}
+
+		if !blockFs.Pruned && blockFs.Value.Header.Number < pruneUpTo {
+			blockFs = BlockFS{Key: blockFs.Key, Value: Block{Header: blockFs.Value.Header}, Pruned: true}
+			prunedCount++
+		}
+
+		blockFsJson, err := json.Marshal(blockFs)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tmp.Write(append(blockFsJson, '\n'))
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return prunedCount, tmp.Close()
+}
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const ReceiptStatusSuccess = "success"
+const ReceiptStatusFailed = "failed"
+
+// Names of the events emitted by txs
+const EventTransfer = "Transfer"
+const EventMint = "Mint"
+const EventBurn = "Burn"
+const EventApproval = "Approval"
+const EventTokenCreated = "TokenCreated"
+const EventMultisigCreated = "MultisigCreated"
+const EventEscrowLocked = "EscrowLocked"
+const EventEscrowReleased = "EscrowReleased"
+const EventContractDeployed = "ContractDeployed"
+const EventContractLog = "ContractLog"
+
+var ErrReceiptNotFound = errors.New("receipt not found")
+var ErrReceiptAmbiguous = errors.New("tx was included more than once")
+
+// Event describes a change made by a tx, e.g. Transfer{from,to,value}
+type Event struct {
+	Name  string   `json:"name"`
+	From  Account  `json:"from,omitempty"`
+	To    Account  `json:"to,omitempty"`
+	Value Amount   `json:"value,omitempty"`
+	Asset string   `json:"asset,omitempty"` // empty for TOK
+	Data  []uint64 `json:"data,omitempty"`  // words logged by a contract
+}
+
+// Receipt records the outcome of a tx included in a block. Failed txs only paid their fee.
+type Receipt struct {
+	TxHash      Hash    `json:"tx_hash"`
+	BlockHash   Hash    `json:"block_hash"`
+	BlockNumber uint64  `json:"block_number"`
+	Status      string  `json:"status"`
+	Error       string  `json:"error,omitempty"`
+	GasUsed     uint64  `json:"gas_used"`
+	Fee         Amount  `json:"fee"`
+	Events      []Event `json:"events"`
+}
+
+// Log is an event together with the tx and block that emitted it
+type Log struct {
+	TxHash      Hash   `json:"tx_hash"`
+	BlockNumber uint64 `json:"block_number"`
+	Event       Event  `json:"event"`
+}
+
+// LogFilter selects the events involving Account in blocks FromBlock to ToBlock included.
+// An empty Account matches every event.
+type LogFilter struct {
+	Account   Account
+	FromBlock uint64
+	ToBlock   uint64
+}
+
+func (f LogFilter) matches(blockNumber uint64, e Event) bool {
+	if blockNumber < f.FromBlock || blockNumber > f.ToBlock {
+		return false
+	}
+	return f.Account == "" || e.From == f.Account || e.To == f.Account
+}
+
+func (s *State) emit(e Event) {
+	s.events = append(s.events, e)
+}
+
+// payFee burns the gas used times the tx gas price from the sender's balance
+func payFee(tx Tx, receipt *Receipt, header BlockHeader, s *State) error {
+	fee, err := tx.GasPrice.MulDiv(receipt.GasUsed, 1)
+	if err != nil {
+		return err
+	}
+	if fee > s.spendable(tx.From, header.Number) {
+		return fmt.Errorf("wrong Tx. Sender '%s' spendable balance is %s TOK. Fee is %s TOK", tx.From, s.spendable(tx.From, header.Number), fee)
+	}
+
+	burned, err := s.supply.Burned.Add(fee)
+	if err != nil {
+		return err
+	}
+	s.supply.Burned = burned
+	s.Balances[tx.From] -= fee
+	receipt.Fee = fee
+	return nil
+}
+
+func feesPaid(receipts []Receipt) Amount {
+	total := Amount(0)
+	for _, r := range receipts {
+		total += r.Fee // bounded by the balances they were paid from
+	}
+	return total
+}
+
+// persistReceipts appends the receipts of a block to the receipts db in a single write.
+// They are written after the block, blocks replayed without receipts get them regenerated.
+func (s *State) persistReceipts(blockHash Hash, receipts []Receipt) error {
+	content, err := marshalReceipts(blockHash, receipts)
+	if err != nil {
+		return err
+	}
+	_, err = s.receiptsFile.Write(content)
+	return err
+}
+
+// marshalReceipts encodes the receipts one per line, setting their block hash unless it is empty
+func marshalReceipts(blockHash Hash, receipts []Receipt) ([]byte, error) {
+	content := make([]byte, 0)
+	for _, r := range receipts {
+		if !blockHash.IsEmpty() {
+			r.BlockHash = blockHash
+		}
+		receiptJson, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		content = append(append(content, receiptJson...), '\n')
+	}
+	return content, nil
+}
+
+// rewriteReceipts drops the receipts not matching keep from the receipts db
+func (s *State) rewriteReceipts(keep func(r Receipt) bool) error {
+	kept := make([]Receipt, 0)
+	err := scanReceipts(s.dataDir, func(r Receipt) bool {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	content, err := marshalReceipts(Hash{}, kept)
+	if err != nil {
+		return err
+	}
+
+	err = s.receiptsFile.Close()
+	if err != nil {
+		return err
+	}
+	replaceErr := replaceFile(getReceiptsDbFilePath(s.dataDir), content)
+
+	// Reopened even if the rewrite failed so new receipts can still be added
+	s.receiptsFile, err = os.OpenFile(getReceiptsDbFilePath(s.dataDir), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if replaceErr != nil {
+		return replaceErr
+	}
+	return err
+}
+
+func scanReceipts(dataDir string, fn func(r Receipt) bool) error {
+	f, err := os.OpenFile(getReceiptsDbFilePath(dataDir), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := newDbScanner(f)
+	for scanner.Scan() {
+		var r Receipt
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return err
+		}
+		if !fn(r) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// receiptBlocks returns the hashes of the blocks with receipts in the receipts db
+func receiptBlocks(dataDir string) (map[Hash]bool, error) {
+	blocks := make(map[Hash]bool)
+	err := scanReceipts(dataDir, func(r Receipt) bool {
+		blocks[r.BlockHash] = true
+		return true
+	})
+	return blocks, err
+}
+
+// GetReceipts returns the receipts of a tx in every block it was included in, the same
+// tx can be included more than once
+func GetReceipts(txHash Hash, dataDir string) ([]Receipt, error) {
+	receipts := make([]Receipt, 0)
+	err := scanReceipts(dataDir, func(r Receipt) bool {
+		if r.TxHash == txHash {
+			receipts = append(receipts, r)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// GetReceipt returns the receipt of a tx included in a block added by this node.
+// It returns ErrReceiptAmbiguous if the tx was included more than once, see GetReceipts.
+func GetReceipt(txHash Hash, dataDir string) (Receipt, error) {
+	receipts, err := GetReceipts(txHash, dataDir)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if len(receipts) == 0 {
+		return Receipt{}, fmt.Errorf("%w for tx '%x'", ErrReceiptNotFound, txHash)
+	}
+	if len(receipts) > 1 {
+		return Receipt{}, fmt.Errorf("%w: tx '%x' is in %d blocks", ErrReceiptAmbiguous, txHash, len(receipts))
+	}
+	return receipts[0], nil
+}
+
+// GetLogs returns the events of successful txs matching the filter in block order
+func GetLogs(filter LogFilter, dataDir string) ([]Log, error) {
+	logs := make([]Log, 0)
+	err := scanReceipts(dataDir, func(r Receipt) bool {
+		if r.BlockNumber > filter.ToBlock {
+			return false
+		}
+		for _, e := range r.Events {
+			if filter.matches(r.BlockNumber, e) {
+				logs = append(logs, Log{r.TxHash, r.BlockNumber, e})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
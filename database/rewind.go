@@ -0,0 +1,265 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// GetLocator lists the hashes of our chain from the tip back to the first block with
+// exponentially growing gaps: the last 10 blocks one by one, then 2, 4, 8... blocks apart.
+// A peer finds our last common block with it without us sending the whole chain.
+func GetLocator(tip Hash, dataDir string) ([]Hash, error) {
+	if tip.IsEmpty() {
+		return []Hash{}, nil
+	}
+
+	headers, err := GetHeadersUpTo(tip, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	locator := make([]Hash, 0)
+	step := 1
+	for i := len(headers) - 1; i > 0; i -= step {
+		locator = append(locator, headers[i].Key)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, headers[0].Key), nil
+}
+
+// FindCommonAncestor returns the first locator hash that is part of our chain.
+// The empty hash means not even the first block is shared.
+func FindCommonAncestor(locator []Hash, dataDir string) (Hash, error) {
+	ours := make(map[Hash]bool)
+	err := scanBlocksDb(dataDir, func(blockFs BlockFS) (bool, error) {
+		ours[blockFs.Key] = true
+		return true, nil
+	})
+	if err != nil {
+		return Hash{}, err
+	}
+
+	for _, hash := range locator {
+		if ours[hash] {
+			return hash, nil
+		}
+	}
+	return Hash{}, nil
+}
+
+// SwitchFork replaces our blocks after the ancestor with the blocks of a peer's fork.
+// The fork is added to a scratch copy of our chain in the fork dir first, our files are only
+// replaced once every fork block was validated. It returns the txs of the mempool and of the
+// dropped blocks that the fork didn't include, for the caller to check against the new state.
+// The empty ancestor means our chains share no block, the fork then replaces all of ours.
+func (s *State) SwitchFork(ancestor Hash, blocks []Block) ([]Tx, error) {
+	kept := make([]BlockFS, 0)
+	dropped := make([]Block, 0)
+	found := ancestor.IsEmpty()
+
+	err := scanBlocksDb(s.dataDir, func(blockFs BlockFS) (bool, error) {
+		if found {
+			dropped = append(dropped, blockFs.Value)
+			return true, nil
+		}
+		kept = append(kept, blockFs)
+		found = blockFs.Key == ancestor
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w '%x'", ErrUnknownBlock, ancestor)
+	}
+	keepUpTo := keptUpTo(kept)
+
+	forkDir := getForkDataDirPath(s.dataDir)
+	defer os.RemoveAll(forkDir)
+
+	fork, err := s.newForkState(forkDir, kept)
+	if err != nil {
+		return nil, fmt.Errorf("unable to rebuild our chain up to block #%d: %w", keepUpTo, err)
+	}
+	err = fork.AddBlocks(blocks)
+	if err != nil {
+		fork.Close()
+		return nil, err
+	}
+
+	if ancestor.IsEmpty() {
+		log.Printf("Switching from %d blocks to the %d blocks of the fork, our chains share no block\n", len(dropped), len(blocks))
+	} else {
+		log.Printf("Switching from %d blocks to the %d blocks of the fork after block #%d '%x'\n", len(dropped), len(blocks), keepUpTo, ancestor)
+	}
+	candidates := make([]Tx, 0)
+	for _, b := range dropped {
+		candidates = append(candidates, b.TXs...)
+	}
+	pending := forkPendingTxs(append(candidates, s.txMempool...), blocks)
+
+	err = s.adoptFork(fork, keepUpTo)
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// keptUpTo returns the number of the last kept block, -1 if none is kept
+func keptUpTo(kept []BlockFS) int64 {
+	if len(kept) == 0 {
+		return -1
+	}
+	return int64(kept[len(kept)-1].Value.Header.Number)
+}
+
+// newForkState opens a scratch state in forkDir holding our blocks, receipts and snapshot
+// up to the ancestor
+func (s *State) newForkState(forkDir string, kept []BlockFS) (*State, error) {
+	err := os.RemoveAll(forkDir)
+	if err != nil {
+		return nil, err
+	}
+	genesisContent, err := ioutil.ReadFile(getGenesisJsonFilePath(s.dataDir))
+	if err != nil {
+		return nil, err
+	}
+	err = initDataDir(forkDir, genesisContent)
+	if err != nil {
+		return nil, err
+	}
+
+	blocksDb := make([]byte, 0)
+	for _, blockFs := range kept {
+		blockFsJson, err := json.Marshal(blockFs)
+		if err != nil {
+			return nil, err
+		}
+		blocksDb = append(append(blocksDb, blockFsJson...), '\n')
+	}
+	err = ioutil.WriteFile(getBlocksDbFilePath(forkDir), blocksDb, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	keepUpTo := keptUpTo(kept)
+	receipts := make([]Receipt, 0)
+	err = scanReceipts(s.dataDir, func(r Receipt) bool {
+		if int64(r.BlockNumber) <= keepUpTo {
+			receipts = append(receipts, r)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	receiptsDb, err := marshalReceipts(Hash{}, receipts)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(getReceiptsDbFilePath(forkDir), receiptsDb, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// A snapshot past the ancestor belongs to the dropped blocks. Without a snapshot the kept
+	// blocks are replayed, which fails if their bodies were pruned.
+	snap, err := loadSnapshot(getSnapshotFilePath(s.dataDir))
+	if err == nil && int64(snap.Height) <= keepUpTo {
+		err = writeSnapshotToDisk(getSnapshotFilePath(forkDir), snap)
+	}
+	if err != nil && err != ErrNoSnapshot {
+		return nil, err
+	}
+
+	return NewStateFromDisk(forkDir)
+}
+
+// adoptFork moves the files of the validated fork state over ours and takes over its state.
+// Every step leaves a data dir that loads: the stale snapshot goes first and the block db
+// rename commits the switch, receipts missing after a crash are regenerated on restart.
+func (s *State) adoptFork(fork *State, keepUpTo int64) error {
+	snap, err := loadSnapshot(getSnapshotFilePath(s.dataDir))
+	if err == nil && int64(snap.Height) > keepUpTo {
+		err = os.Remove(getSnapshotFilePath(s.dataDir))
+	}
+	if err != nil && err != ErrNoSnapshot {
+		fork.Close()
+		return err
+	}
+
+	err = fork.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(getBlocksDbFilePath(fork.dataDir), getBlocksDbFilePath(s.dataDir))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(getReceiptsDbFilePath(fork.dataDir), getReceiptsDbFilePath(s.dataDir))
+	if err != nil {
+		log.Printf("Unable to replace the receipts db, it is rebuilt on restart. Err: %s\n", err)
+	}
+	if fileExist(getSnapshotFilePath(fork.dataDir)) {
+		err = os.Rename(getSnapshotFilePath(fork.dataDir), getSnapshotFilePath(s.dataDir))
+		if err != nil {
+			log.Printf("Unable to replace the snapshot, it is taken again at the next interval. Err: %s\n", err)
+		}
+	}
+
+	fork.dbFile, err = os.OpenFile(getBlocksDbFilePath(s.dataDir), os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	fork.receiptsFile, err = os.OpenFile(getReceiptsDbFilePath(s.dataDir), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		fork.dbFile.Close()
+		return err
+	}
+	fork.dataDir = s.dataDir
+
+	err = s.Close()
+	if err != nil {
+		log.Printf("Error while closing the db files of the abandoned chain. Err: %s\n", err)
+	}
+	*s = *fork
+	return nil
+}
+
+// forkPendingTxs lists the non reward candidate txs that the fork blocks didn't include
+func forkPendingTxs(candidates []Tx, fork []Block) []Tx {
+	included := make(map[Hash]bool)
+	for _, b := range fork {
+		for _, tx := range b.TXs {
+			hash, err := tx.Hash()
+			if err == nil {
+				included[hash] = true
+			}
+		}
+	}
+
+	pending := make([]Tx, 0)
+	for _, tx := range candidates {
+		hash, err := tx.Hash()
+		if err != nil || included[hash] || tx.isReward() {
+			continue
+		}
+		pending = append(pending, tx)
+	}
+	return pending
+}
+
+// replaceFile writes the content to a tmp file first so a crash never leaves a partial file
+func replaceFile(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
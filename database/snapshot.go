@@ -0,0 +1,222 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// A snapshot of the state is persisted every SnapshotInterval blocks
+const SnapshotInterval uint64 = 50
+
+var ErrNoSnapshot = errors.New("no snapshot available")
+
+// Snapshot is the full account state right after the block at Height was applied.
+// Fresh nodes can bootstrap from it instead of replaying every block since genesis.
+type Snapshot struct {
+	Height        uint64                         `json:"height"`
+	BlockHash     Hash                           `json:"block_hash"`
+	Block         Block                          `json:"block"`
+	StateRoot     Hash                           `json:"state_root"`
+	Balances      map[Account]Amount             `json:"balances"`
+	Multisig      map[Account]MultisigAccount    `json:"multisig"`
+	Tokens        map[string]Token               `json:"tokens"`
+	TokenBalances map[string]map[Account]Amount  `json:"token_balances"`
+	Supply        Supply                         `json:"supply"`
+	Allowances    map[Account]map[Account]Amount `json:"allowances"`
+	Escrows       map[Hash]Escrow                `json:"escrows"`
+	Contracts     map[Account]Contract           `json:"contracts,omitempty"`
+}
+
+// BlockHeaderFS is a block header together with the hash of its block
+type BlockHeaderFS struct {
+	Key    Hash        `json:"hash"`
+	Header BlockHeader `json:"header"`
+}
+
+// ComputeStateRoot hashes everything in the snapshot except the block it was taken at
+func (snap Snapshot) ComputeStateRoot() (Hash, error) {
+	body := snap
+	body.Height = 0
+	body.BlockHash = Hash{}
+	body.Block = Block{}
+	body.StateRoot = Hash{}
+
+	bodyJson, err := json.Marshal(body)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(bodyJson), nil
+}
+
+// Verify checks the snapshot is self consistent and that the header chain
+// links genesis to the snapshot block
+func (snap Snapshot) Verify(headers []BlockHeaderFS) error {
+	blockHash, err := snap.Block.Hash()
+	if err != nil {
+		return err
+	}
+	if blockHash != snap.BlockHash {
+		return fmt.Errorf("snapshot block hash is '%x' but its block hashes to '%x'", snap.BlockHash, blockHash)
+	}
+	if snap.Block.Header.Number != snap.Height {
+		return fmt.Errorf("snapshot height is %d but its block number is %d", snap.Height, snap.Block.Header.Number)
+	}
+
+	root, err := snap.ComputeStateRoot()
+	if err != nil {
+		return err
+	}
+	if root != snap.StateRoot {
+		return fmt.Errorf("snapshot state root is '%x' but its state hashes to '%x'", snap.StateRoot, root)
+	}
+
+	if uint64(len(headers)) != snap.Height+1 {
+		return fmt.Errorf("expected %d headers up to the snapshot, got %d", snap.Height+1, len(headers))
+	}
+	for i, h := range headers {
+		if h.Header.Number != uint64(i) {
+			return fmt.Errorf("header #%d has block number %d", i, h.Header.Number)
+		}
+		if i > 0 && h.Header.Parent != headers[i-1].Key {
+			return fmt.Errorf("header #%d parent '%x' does not match previous header '%x'", i, h.Header.Parent, headers[i-1].Key)
+		}
+	}
+	last := headers[len(headers)-1]
+	if last.Key != snap.BlockHash || last.Header != snap.Block.Header {
+		return fmt.Errorf("header chain does not end at the snapshot block '%x'", snap.BlockHash)
+	}
+	return nil
+}
+
+func loadSnapshot(path string) (Snapshot, error) {
+	if !fileExist(path) {
+		return Snapshot{}, ErrNoSnapshot
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var snap Snapshot
+	err = json.Unmarshal(content, &snap)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snap, nil
+}
+
+// writeSnapshotToDisk replaces the snapshot file at once, a crash or a concurrent
+// reader never sees a partial snapshot
+func writeSnapshotToDisk(path string, snap Snapshot) error {
+	snapJson, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, snapJson)
+}
+
+// LoadSnapshot returns the latest snapshot persisted in the data dir
+func LoadSnapshot(dataDir string) (Snapshot, error) {
+	return loadSnapshot(getSnapshotFilePath(dataDir))
+}
+
+// snapshot captures the current state at the latest block
+func (s *State) snapshot() (Snapshot, error) {
+	snap := Snapshot{
+		Height:    s.latestBlock.Header.Number,
+		BlockHash: s.latestBlockHash,
+		Block:     s.latestBlock,
+		Balances:  make(map[Account]Amount),
+		Multisig:  make(map[Account]MultisigAccount),
+	}
+	for acc, balance := range s.Balances {
+		snap.Balances[acc] = balance
+	}
+	for acc, m := range s.multisig {
+		snap.Multisig[acc] = m
+	}
+	snap.Tokens, snap.TokenBalances = copyTokens(s.tokens, s.tokenBalances)
+	snap.Supply = s.supply
+	snap.Allowances = copyAllowances(s.allowances)
+	snap.Escrows = copyEscrows(s.escrows)
+	snap.Contracts = copyContracts(s.contracts)
+
+	root, err := snap.ComputeStateRoot()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.StateRoot = root
+	return snap, nil
+}
+
+// restore replaces the state with the one captured in the snapshot
+func (s *State) restore(snap Snapshot) {
+	s.Balances = make(map[Account]Amount)
+	for acc, balance := range snap.Balances {
+		s.Balances[acc] = balance
+	}
+	s.multisig = make(map[Account]MultisigAccount)
+	for acc, m := range snap.Multisig {
+		s.multisig[acc] = m
+	}
+	s.tokens, s.tokenBalances = copyTokens(snap.Tokens, snap.TokenBalances)
+	s.supply = snap.Supply
+	s.allowances = copyAllowances(snap.Allowances)
+	s.escrows = copyEscrows(snap.Escrows)
+	s.contracts = copyContracts(snap.Contracts)
+	s.latestBlock = snap.Block
+	s.latestBlockHash = snap.BlockHash
+	s.hasGenesisBlock = true
+}
+
+func (s *State) persistSnapshot() error {
+	snap, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	log.Printf("Persisting state snapshot at block #%d root '%x'\n", snap.Height, snap.StateRoot)
+	return writeSnapshotToDisk(getSnapshotFilePath(s.dataDir), snap)
+}
+
+// InstallSnapshot bootstraps an empty state from a verified snapshot.
+// Only the headers are written to the block db, bodies before the snapshot stay with the peers.
+func (s *State) InstallSnapshot(snap Snapshot, headers []BlockHeaderFS) error {
+	if !s.latestBlockHash.IsEmpty() {
+		return fmt.Errorf("cannot install a snapshot over an existing chain at '%x'", s.latestBlockHash)
+	}
+
+	err := snap.Verify(headers)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Installing snapshot at block #%d\n", snap.Height)
+	// Receipts of blocks before the snapshot are not available, drop any left by a previous chain
+	err = s.receiptsFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	for _, h := range headers {
+		blockFsJson, err := json.Marshal(BlockFS{Key: h.Key, Value: Block{Header: h.Header}, Pruned: true})
+		if err != nil {
+			return err
+		}
+		_, err = s.dbFile.Write(append(blockFsJson, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeSnapshotToDisk(getSnapshotFilePath(s.dataDir), snap)
+	if err != nil {
+		return err
+	}
+
+	s.restore(snap)
+	return nil
+}
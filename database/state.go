@@ -15,22 +15,40 @@ since Genesis in a sequence
 package database
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/harshrpg/go-blockchain-tut/fs"
 )
 
 type State struct {
-	Balances        map[Account]uint
+	Balances        map[Account]Amount
 	txMempool       []Tx
+	mempoolHashes   map[Hash]bool // index of txMempool
 	dbFile          *os.File
 	latestBlockHash Hash
 	latestBlock     Block
 	hasGenesisBlock bool
+	dataDir         string
+	chainID         string
+	genesisHash     Hash
+	consensus       ConsensusParams
+	vesting         map[Account]Vesting
+	multisig        map[Account]MultisigAccount
+	tokens          map[string]Token
+	tokenBalances   map[string]map[Account]Amount
+	supply          Supply
+	maxSupply       Amount
+	allowances      map[Account]map[Account]Amount // owner -> spender -> allowance
+	escrows         map[Hash]Escrow
+	contracts       map[Account]Contract
+	receiptsFile    *os.File
+	events          []Event // emitted by the tx being applied
 }
 
 // The state struct is constructed by reading the initial user balances from the genesis.json file
@@ -46,9 +64,16 @@ func NewStateFromDisk(dataDir string) (*State, error) {
 		return nil, err
 	}
 
-	balances := make(map[Account]uint)
+	genHash, err := gen.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make(map[Account]Amount)
+	genesisSupply := Amount(0)
 	for account, balance := range gen.Balances {
 		balances[account] = balance
+		genesisSupply += balance // genesis validation already ruled out overflows
 	}
 
 	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_APPEND|os.O_RDWR, 0600)
@@ -56,15 +81,56 @@ func NewStateFromDisk(dataDir string) (*State, error) {
 		return nil, err
 	}
 
-	scanner := bufio.NewScanner(f)
+	receiptsFile, err := os.OpenFile(getReceiptsDbFilePath(dataDir), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
 
-	state := &State{balances, make([]Tx, 0), f, Hash{}, Block{}, false}
+	scanner := newDbScanner(f)
 
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return nil, err
-		}
+	multisig := make(map[Account]MultisigAccount)
+	for account, m := range gen.Multisig {
+		multisig[account] = m
+	}
+
+	state := &State{
+		Balances:      balances,
+		txMempool:     make([]Tx, 0),
+		mempoolHashes: make(map[Hash]bool),
+		dbFile:        f,
+		dataDir:       dataDir,
+		chainID:       gen.ChainID,
+		genesisHash:   genHash,
+		consensus:     gen.consensusParams(),
+		vesting:       gen.Vesting,
+		multisig:      multisig,
+		tokens:        make(map[string]Token),
+		tokenBalances: make(map[string]map[Account]Amount),
+		supply:        Supply{Minted: genesisSupply},
+		maxSupply:     gen.MaxSupply,
+		allowances:    make(map[Account]map[Account]Amount),
+		escrows:       make(map[Hash]Escrow),
+		contracts:     make(map[Account]Contract),
+		receiptsFile:  receiptsFile,
+	}
 
+	// Blocks up to the latest snapshot don't need to be replayed
+	snap, err := loadSnapshot(getSnapshotFilePath(dataDir))
+	hasSnapshot := err == nil
+	if err != nil && err != ErrNoSnapshot {
+		return nil, err
+	}
+	if hasSnapshot {
+		log.Printf("Loading state from snapshot at block #%d\n", snap.Height)
+		state.restore(snap)
+	}
+
+	withReceipts, err := receiptBlocks(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for scanner.Scan() {
 		// Convert each indicidual json line into an object
 		blockFsJson := scanner.Bytes()
 		if len(blockFsJson) == 0 {
@@ -76,14 +142,33 @@ func NewStateFromDisk(dataDir string) (*State, error) {
 			return nil, err
 		}
 
+		if hasSnapshot && blockFs.Value.Header.Number <= snap.Height {
+			continue
+		}
+		if blockFs.Pruned {
+			return nil, fmt.Errorf("%w: block #%d is not covered by a snapshot", ErrBlockPruned, blockFs.Value.Header.Number)
+		}
+
 		// state.apply(tx) builds a state with the read transaction from the db file
-		err = applyTxs(blockFs.Value.TXs, state)
+		receipts, err := applyTxs(blockFs.Value.TXs, blockFs.Value.Header, state)
 		if err != nil {
 			return nil, err
 		}
+		// The receipts are persisted when the block is added, unless the node stopped in between
+		if !withReceipts[blockFs.Key] && len(receipts) > 0 {
+			log.Printf("Regenerating the receipts of block #%d\n", blockFs.Value.Header.Number)
+			err = state.persistReceipts(blockFs.Key, receipts)
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		state.latestBlockHash = blockFs.Key
 		state.latestBlock = blockFs.Value
+		state.hasGenesisBlock = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
 
 	return state, nil
@@ -97,6 +182,14 @@ func (s *State) LatestBlock() Block {
 	return s.latestBlock
 }
 
+func (s *State) ChainID() string {
+	return s.chainID
+}
+
+func (s *State) GenesisHash() Hash {
+	return s.genesisHash
+}
+
 func (s *State) AddBlocks(blocks []Block) error {
 	log.Println("Adding blocks into db")
 	for i, b := range blocks {
@@ -115,9 +208,9 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 	log.Println("Initializing state copy")
 	pendingState := s.copy()
 	log.Println("State copy completed")
-	err := applyBlock(b, pendingState)
+	receipts, err := applyBlock(b, &pendingState)
 	if err != nil {
-		return Hash{}, err
+		return Hash{}, fmt.Errorf("%w: %s", ErrInvalidBlock, err.Error())
 	}
 
 	log.Println("Calculating Block Hash")
@@ -127,7 +220,7 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 	}
 
 	log.Println("Making the blockfs wrapper")
-	blockFs := BlockFS{blockHash, b}
+	blockFs := BlockFS{Key: blockHash, Value: b}
 
 	log.Println("Marshalling blockfs into a json object")
 	blockFsJson, err := json.Marshal(blockFs)
@@ -140,78 +233,262 @@ func (s *State) AddBlock(b Block) (Hash, error) {
 	if err != nil {
 		return Hash{}, err
 	}
+	// The block is on disk from here, the state must follow it even without its receipts
+	err = s.persistReceipts(blockHash, receipts)
+	if err != nil {
+		log.Printf("Unable to persist the receipts of block #%d, they are regenerated on restart. Err: %s\n", b.Header.Number, err)
+	}
 	log.Println("Updating State balances")
 	s.Balances = pendingState.Balances
+	s.multisig = pendingState.multisig
+	s.tokens = pendingState.tokens
+	s.tokenBalances = pendingState.tokenBalances
+	s.supply = pendingState.supply
+	s.allowances = pendingState.allowances
+	s.escrows = pendingState.escrows
+	s.contracts = pendingState.contracts
 	log.Println("Updating State's latestBlock")
 	s.latestBlock = b
 	log.Println("Updating State's latestBlockHash")
 	s.latestBlockHash = blockHash
+	s.hasGenesisBlock = true
+	s.removeFromMempool(b)
+
+	if b.Header.Number > 0 && b.Header.Number%SnapshotInterval == 0 {
+		err = s.persistSnapshot()
+		if err != nil {
+			return Hash{}, err
+		}
+	}
 	return blockHash, nil
 }
 
-func applyBlock(b Block, s State) error {
+func applyBlock(b Block, s *State) ([]Receipt, error) {
 	log.Println("Validating if block can be added as a transaction")
 	nextExpectedBlockNumber := s.latestBlock.Header.Number + 1
 	log.Printf("Next Expected Block Number: %d\n", nextExpectedBlockNumber)
 
 	if s.hasGenesisBlock && b.Header.Number != nextExpectedBlockNumber {
-		log.Fatalf("Next Expected Block Number must be '%d' not '%d'", nextExpectedBlockNumber, b.Header.Number)
+		return nil, fmt.Errorf("next expected block number must be '%d' not '%d'", nextExpectedBlockNumber, b.Header.Number)
+	}
+	// An empty chain, e.g. one rebuilt to switch to a fork sharing no block with ours, starts at block #0
+	if !s.hasGenesisBlock && (b.Header.Number != 0 || !b.Header.Parent.IsEmpty()) {
+		return nil, fmt.Errorf("first block must be block #0 without a parent, not block #%d", b.Header.Number)
 	}
 
 	log.Println("Checking if current block's parent is the latest block in the db")
-	if s.hasGenesisBlock && s.latestBlock.Header.Number > 0 && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
-		log.Fatalf("Next Block parent hash must be '%x' and not '%x'", s.latestBlockHash, b.Header.Parent)
+	if s.hasGenesisBlock && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
+		return nil, fmt.Errorf("next block parent hash must be '%x' and not '%x'", s.latestBlockHash, b.Header.Parent)
+	}
+
+	// Time locked txs are checked against the block time, the producer can't pick it freely
+	if s.hasGenesisBlock && b.Header.Time < s.latestBlock.Header.Time {
+		return nil, fmt.Errorf("block #%d time %d is before its parent's time %d", b.Header.Number, b.Header.Time, s.latestBlock.Header.Time)
+	}
+	if maxTime := uint64(time.Now().Add(MaxBlockTimeDrift).Unix()); b.Header.Time > maxTime {
+		return nil, fmt.Errorf("block #%d time %d is more than %s ahead of our clock", b.Header.Number, b.Header.Time, MaxBlockTimeDrift)
+	}
+
+	if s.consensus.MaxBlockTxs > 0 && uint64(len(b.TXs)) > s.consensus.MaxBlockTxs {
+		return nil, fmt.Errorf("block has %d transactions, the limit is %d", len(b.TXs), s.consensus.MaxBlockTxs)
 	}
 
+	burnedBefore := s.supply.Burned
+
 	log.Println("Block valid. Applying transactions")
-	return applyTxs(b.TXs, &s)
+	receipts, err := applyTxs(b.TXs, b.Header, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if burned := s.supply.Burned - burnedBefore - feesPaid(receipts); burned != b.Header.Burned {
+		return nil, fmt.Errorf("block #%d declares %s TOK burned but its txs burned %s TOK", b.Header.Number, b.Header.Burned, burned)
+	}
+
+	err = checkBlockGas(b, receipts, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipts, checkSupplyInvariant(b, s)
 }
 
-func applyTxs(txs []Tx, s *State) error {
+func applyTxs(txs []Tx, header BlockHeader, s *State) ([]Receipt, error) {
+	receipts := make([]Receipt, 0, len(txs))
 	for _, tx := range txs {
-		err := applyTx(tx, s)
+		receipt, err := applyTx(tx, header, s)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		receipts = append(receipts, receipt)
 	}
 	log.Println("All transactions applied.")
-	return nil
+	return receipts, nil
 }
 
 // Changing/ Validating the state
 
-func applyTx(tx Tx, s *State) error {
+// applyTx changes the state and returns the tx receipt with the gas it used,
+// the fee it paid and the events it emitted
+func applyTx(tx Tx, header BlockHeader, s *State) (Receipt, error) {
+	s.events = make([]Event, 0)
+	err := tx.checkValidAt(header)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	txHash, err := tx.Hash()
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipt := Receipt{TxHash: txHash, BlockNumber: header.Number, Status: ReceiptStatusSuccess, GasUsed: tx.IntrinsicGas()}
+
 	if tx.isReward() {
-		s.Balances[tx.To] += tx.Value
-		return nil
+		if tx.Asset != "" {
+			return Receipt{}, fmt.Errorf("rewards are only paid in TOK")
+		}
+		err = mint(tx.To, tx.Value, s)
+		if err != nil {
+			return Receipt{}, err
+		}
+		receipt.Events = s.events
+		return receipt, nil
+	}
+
+	if _, isContract := s.contracts[tx.From]; isContract {
+		return Receipt{}, fmt.Errorf("contract '%s' can't send txs", tx.From)
+	}
+
+	err = authorizeMultisig(tx, s)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	switch tx.Kind {
+	case "":
+		if tx.Asset != "" {
+			err = applyTokenTransfer(tx, s)
+		} else {
+			err = applyTransfer(tx, header, s)
+		}
+	case TxKindMultisigCreate:
+		err = applyMultisigCreate(tx, s)
+		if err == nil {
+			err = applyTransfer(tx, header, s)
+		}
+	case TxKindTokenCreate:
+		err = applyTokenCreate(tx, s)
+	case TxKindBurn:
+		err = applyBurn(tx, header, s)
+	case TxKindApprove:
+		err = applyApprove(tx, s)
+	case TxKindTransferFrom:
+		err = applyTransferFrom(tx, header, s)
+	case TxKindEscrowLock:
+		err = applyEscrowLock(tx, header, s)
+	case TxKindEscrowClaim:
+		err = applyEscrowClaim(tx, header, s)
+	case TxKindEscrowRefund:
+		err = applyEscrowRefund(tx, header, s)
+	case TxKindContractDeploy:
+		err = applyContractDeploy(tx, header, s)
+	case TxKindContractCall:
+		var execGas uint64
+		execGas, err = applyContractCall(tx, header, s)
+		receipt.GasUsed += execGas
+		if errors.Is(err, ErrContractFailed) {
+			// The call is included and pays its fee, but changes nothing else
+			receipt.Status = ReceiptStatusFailed
+			receipt.Error = err.Error()
+			err = nil
+		}
+	default:
+		err = fmt.Errorf("unknown tx kind '%s'", tx.Kind)
+	}
+	if err != nil {
+		return Receipt{}, err
 	}
 
-	if tx.Value > s.Balances[tx.From] {
-		log.Fatalf("Wrong Tx. Sender '%s' balance is %d TOK. Tx cost is %d TOK", tx.From, s.Balances[tx.From], tx.Value)
+	err = payFee(tx, &receipt, header, s)
+	if err != nil {
+		return Receipt{}, err
 	}
 
-	s.Balances[tx.From] -= tx.Value
-	s.Balances[tx.To] += tx.Value
+	receipt.Events = s.events
+	return receipt, nil
+}
+
+// applyTransfer moves TOK from the sender to the recipient
+func applyTransfer(tx Tx, header BlockHeader, s *State) error {
+	if tx.Asset != "" {
+		return fmt.Errorf("tx kind '%s' only moves TOK", tx.Kind)
+	}
+
+	if tx.Value > s.spendable(tx.From, header.Number) {
+		return fmt.Errorf("wrong Tx. Sender '%s' spendable balance is %s TOK. Tx cost is %s TOK", tx.From, s.spendable(tx.From, header.Number), tx.Value)
+	}
+
+	err := moveAmount(s.Balances, tx.From, tx.To, tx.Value)
+	if err != nil {
+		return err
+	}
+	s.emit(Event{Name: EventTransfer, From: tx.From, To: tx.To, Value: tx.Value})
 	return nil
 }
 
-// close the db file
+// moveAmount debits from and credits to, rejecting the move if either balance would wrap
+func moveAmount(balances map[Account]Amount, from Account, to Account, value Amount) error {
+	fromBalance, err := balances[from].Sub(value)
+	if err != nil {
+		return err
+	}
+	balances[from] = fromBalance
+
+	toBalance, err := balances[to].Add(value)
+	if err != nil {
+		balances[from] += value
+		return err
+	}
+	balances[to] = toBalance
+	return nil
+}
+
+// close the db files
 func (s *State) Close() error {
+	err := s.receiptsFile.Close()
+	if err != nil {
+		return err
+	}
 	return s.dbFile.Close()
 }
 
 // Internal method to return a copy of the state for security reasons
 func (s *State) copy() State {
 	c := State{}
+	c.dataDir = s.dataDir
+	c.chainID = s.chainID
+	c.genesisHash = s.genesisHash
+	c.consensus = s.consensus
+	c.vesting = s.vesting
+	c.multisig = make(map[Account]MultisigAccount)
+	for acc, m := range s.multisig {
+		c.multisig[acc] = m
+	}
+	c.tokens, c.tokenBalances = copyTokens(s.tokens, s.tokenBalances)
+	c.supply = s.supply
+	c.maxSupply = s.maxSupply
+	c.allowances = copyAllowances(s.allowances)
+	c.escrows = copyEscrows(s.escrows)
+	c.contracts = copyContracts(s.contracts)
 	c.hasGenesisBlock = s.hasGenesisBlock
 	log.Println("Genesis Block status Copied Successfully")
 	c.latestBlock = s.latestBlock
 	log.Println("Block Copied Successfully")
 	c.latestBlockHash = s.latestBlockHash
 	log.Println("Block hash Copied Successfully")
-	c.txMempool = make([]Tx, len(s.txMempool))
+	c.txMempool = make([]Tx, 0, len(s.txMempool))
 	log.Println("Block hash Copied Successfully")
-	c.Balances = make(map[Account]uint)
+	c.Balances = make(map[Account]Amount)
 	log.Println("Initializing account balance copy")
 	for acc, balance := range s.Balances {
 		c.Balances[acc] = balance
@@ -223,6 +500,10 @@ func (s *State) copy() State {
 		c.txMempool = append(c.txMempool, tx)
 		log.Printf("DEV::Mempool transaction#%d copied successfully", i)
 	}
+	c.mempoolHashes = make(map[Hash]bool, len(s.mempoolHashes))
+	for hash := range s.mempoolHashes {
+		c.mempoolHashes[hash] = true
+	}
 	return c
 }
 
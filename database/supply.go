@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+)
+
+// Supply tracks the TOK ever minted (genesis balances and rewards) and burned (burn txs and fees)
+type Supply struct {
+	Minted Amount `json:"minted"`
+	Burned Amount `json:"burned"`
+}
+
+func (sup Supply) Circulating() Amount {
+	return sup.Minted - sup.Burned
+}
+
+func (s *State) Supply() Supply {
+	return s.supply
+}
+
+// MaxSupply is the cap on minted TOK declared in genesis, 0 means uncapped
+func (s *State) MaxSupply() Amount {
+	return s.maxSupply
+}
+
+// mint credits a reward to the account. Rewards beyond the max supply are rejected,
+// so a block never records TOK that wasn't created.
+func mint(account Account, value Amount, s *State) error {
+	if s.maxSupply > 0 {
+		remaining := Amount(0)
+		if s.supply.Minted < s.maxSupply {
+			remaining = s.maxSupply - s.supply.Minted
+		}
+		if value > remaining {
+			return fmt.Errorf("reward of %s TOK to '%s' exceeds the %s TOK left below the max supply of %s TOK", value, account, remaining, s.maxSupply)
+		}
+	}
+
+	minted, err := s.supply.Minted.Add(value)
+	if err != nil {
+		return err
+	}
+	balance, err := s.Balances[account].Add(value)
+	if err != nil {
+		return err
+	}
+
+	s.supply.Minted = minted
+	s.Balances[account] = balance
+	s.emit(Event{Name: EventMint, To: account, Value: value})
+	return nil
+}
+
+// applyBurn destroys TOK from the sender's balance, reducing the circulating supply
+func applyBurn(tx Tx, header BlockHeader, s *State) error {
+	if tx.Asset != "" {
+		return fmt.Errorf("only TOK can be burned")
+	}
+	if tx.To != "" {
+		return fmt.Errorf("burn tx must not have a recipient")
+	}
+	if tx.Value > s.spendable(tx.From, header.Number) {
+		return fmt.Errorf("wrong Tx. Sender '%s' spendable balance is %s TOK. Burn is %s TOK", tx.From, s.spendable(tx.From, header.Number), tx.Value)
+	}
+
+	burned, err := s.supply.Burned.Add(tx.Value)
+	if err != nil {
+		return err
+	}
+	s.supply.Burned = burned
+	s.Balances[tx.From] -= tx.Value
+	s.emit(Event{Name: EventBurn, From: tx.From, Value: tx.Value})
+	return nil
+}
+
+// totalBalance is the amount of TOK held by all accounts
+func (s *State) totalBalance() (Amount, error) {
+	total := Amount(0)
+	for _, balance := range s.Balances {
+		var err error
+		total, err = total.Add(balance)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// checkSupplyInvariant verifies that the TOK held by all accounts and escrows is exactly the
+// circulating supply, and that the balances of every token still add up to its fixed supply
+func checkSupplyInvariant(b Block, s *State) error {
+	held, err := s.totalBalance()
+	if err != nil {
+		return err
+	}
+	escrowed, err := s.totalEscrowed()
+	if err != nil {
+		return err
+	}
+	total, err := held.Add(escrowed)
+	if err != nil {
+		return err
+	}
+	if total != s.supply.Circulating() {
+		return fmt.Errorf("supply invariant violated in block #%d: %s TOK held, %s TOK circulating", b.Header.Number, total, s.supply.Circulating())
+	}
+
+	for name, token := range s.tokens {
+		held := Amount(0)
+		for _, balance := range s.tokenBalances[name] {
+			held, err = held.Add(balance)
+			if err != nil {
+				return err
+			}
+		}
+		if held != token.Supply {
+			return fmt.Errorf("supply invariant violated in block #%d: %s %s held, supply is %s", b.Header.Number, held, name, token.Supply)
+		}
+	}
+	return nil
+}
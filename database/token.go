@@ -0,0 +1,98 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The native currency, balances in TOK are kept in State.Balances
+const NativeAsset = "TOK"
+
+// Token is an asset with a fixed supply created by a token_create tx
+type Token struct {
+	Name   string  `json:"name"`
+	Issuer Account `json:"issuer"`
+	Supply Amount  `json:"supply"`
+}
+
+// applyTokenCreate issues a new token whose whole supply is credited to the issuer
+func applyTokenCreate(tx Tx, s *State) error {
+	if tx.Asset == "" || tx.Asset == NativeAsset {
+		return fmt.Errorf("invalid token name '%s'", tx.Asset)
+	}
+	if _, exists := s.tokens[tx.Asset]; exists {
+		return fmt.Errorf("token '%s' already exists", tx.Asset)
+	}
+	if tx.Value == 0 {
+		return fmt.Errorf("token '%s' must have a supply", tx.Asset)
+	}
+
+	s.tokens[tx.Asset] = Token{Name: tx.Asset, Issuer: tx.From, Supply: tx.Value}
+	s.tokenBalances[tx.Asset] = map[Account]Amount{tx.From: tx.Value}
+	s.emit(Event{Name: EventTokenCreated, From: tx.From, Value: tx.Value, Asset: tx.Asset})
+	return nil
+}
+
+func applyTokenTransfer(tx Tx, s *State) error {
+	balances, exists := s.tokenBalances[tx.Asset]
+	if !exists {
+		return fmt.Errorf("unknown token '%s'", tx.Asset)
+	}
+
+	if tx.Value > balances[tx.From] {
+		return fmt.Errorf("wrong Tx. Sender '%s' balance is %s %s. Tx cost is %s %s", tx.From, balances[tx.From], tx.Asset, tx.Value, tx.Asset)
+	}
+
+	err := moveAmount(balances, tx.From, tx.To, tx.Value)
+	if err != nil {
+		return err
+	}
+	s.emit(Event{Name: EventTransfer, From: tx.From, To: tx.To, Value: tx.Value, Asset: tx.Asset})
+	return nil
+}
+
+// Tokens returns every token issued on the chain sorted by name
+func (s *State) Tokens() []Token {
+	tokens := make([]Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	return tokens
+}
+
+// AssetBalances returns a copy of the balances of the given asset, TOK or a token
+func (s *State) AssetBalances(asset string) (map[Account]Amount, error) {
+	balances := s.Balances
+	if asset != "" && asset != NativeAsset {
+		var exists bool
+		balances, exists = s.tokenBalances[asset]
+		if !exists {
+			return nil, fmt.Errorf("unknown token '%s'", asset)
+		}
+	}
+
+	balancesCopy := make(map[Account]Amount, len(balances))
+	for acc, balance := range balances {
+		balancesCopy[acc] = balance
+	}
+	return balancesCopy, nil
+}
+
+func copyTokens(tokens map[string]Token, tokenBalances map[string]map[Account]Amount) (map[string]Token, map[string]map[Account]Amount) {
+	tokensCopy := make(map[string]Token)
+	for name, token := range tokens {
+		tokensCopy[name] = token
+	}
+
+	balancesCopy := make(map[string]map[Account]Amount)
+	for name, balances := range tokenBalances {
+		balancesCopy[name] = make(map[Account]Amount)
+		for acc, balance := range balances {
+			balancesCopy[name][acc] = balance
+		}
+	}
+	return tokensCopy, balancesCopy
+}
@@ -1,5 +1,30 @@
 package database
 
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Lock times below this are block heights, lock times from it on are unix timestamps
+const LockTimeThreshold uint64 = 500000000
+
+var ErrTxNotYetValid = errors.New("tx is not valid yet")
+var ErrTxExpired = errors.New("tx has expired")
+
+// Kinds of txs besides plain transfers
+const TxKindMultisigCreate = "multisig_create"
+const TxKindTokenCreate = "token_create"
+const TxKindBurn = "burn"
+const TxKindApprove = "approve"
+const TxKindTransferFrom = "transfer_from"
+const TxKindEscrowLock = "escrow_lock"
+const TxKindEscrowClaim = "escrow_claim"
+const TxKindEscrowRefund = "escrow_refund"
+const TxKindContractDeploy = "contract_deploy"
+const TxKindContractCall = "contract_call"
+
 type Account string
 
 func NewAccount(value string) Account {
@@ -9,14 +34,79 @@ func NewAccount(value string) Account {
 type Tx struct {
 	From  Account `json:"from"`
 	To    Account `json:"to"`
-	Value uint    `json:"value"`
-	Data  string  `json:"data"`
+	Value Amount  `json:"value"`
+	// Free form, hex bytecode for contract_deploy and hex call input for contract_call txs
+	Data string `json:"data"`
+	// Optional validity window, each a block height or a unix timestamp (see LockTimeThreshold)
+	ValidAfter uint64 `json:"valid_after,omitempty"`
+	ValidUntil uint64 `json:"valid_until,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	// Name of the token moved by the tx, empty for TOK
+	Asset string `json:"asset,omitempty"`
+	// Account debited by a transfer_from tx, the sender spends its allowance
+	Owner Account `json:"owner,omitempty"`
+	// TOK paid per gas used, the fee is burned
+	GasPrice Amount `json:"gas_price,omitempty"`
+	// Hash lock, timeout or preimage of escrow txs
+	Escrow *EscrowTx `json:"escrow,omitempty"`
+	// Required for txs sent from multisig accounts
+	Nonce      uint64      `json:"nonce,omitempty"`
+	Signatures []Signature `json:"signatures,omitempty"`
+	// Policy of the account created by a multisig_create tx
+	Multisig *MultisigAccount `json:"multisig,omitempty"`
 }
 
-func NewTx(from Account, to Account, value uint, data string) Tx {
-	return Tx{from, to, value, data}
+func NewTx(from Account, to Account, value Amount, data string) Tx {
+	return Tx{From: from, To: to, Value: value, Data: data}
 }
 
 func (t Tx) isReward() bool {
 	return t.Data == "reward"
 }
+
+func (t Tx) isBurn() bool {
+	return t.Kind == TxKindBurn
+}
+
+func (t Tx) Hash() (Hash, error) {
+	txJson, err := json.Marshal(t)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(txJson), nil
+}
+
+// SigningHash is the hash signed by the owners of a multisig account, i.e. the tx without its signatures.
+// It includes the chain id so a signature can't be replayed on another chain sharing the same keys.
+func (t Tx) SigningHash(chainID string) (Hash, error) {
+	t.Signatures = nil
+	payload := struct {
+		ChainID string `json:"chain_id"`
+		Tx      Tx     `json:"tx"`
+	}{chainID, t}
+
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(payloadJson), nil
+}
+
+// checkValidAt returns ErrTxNotYetValid or ErrTxExpired if the tx can't be included in a block with this header
+func (t Tx) checkValidAt(header BlockHeader) error {
+	if t.ValidAfter > 0 && lockTimeOf(t.ValidAfter, header) < t.ValidAfter {
+		return fmt.Errorf("%w: valid after %d", ErrTxNotYetValid, t.ValidAfter)
+	}
+	if t.ValidUntil > 0 && lockTimeOf(t.ValidUntil, header) > t.ValidUntil {
+		return fmt.Errorf("%w: valid until %d", ErrTxExpired, t.ValidUntil)
+	}
+	return nil
+}
+
+// lockTimeOf picks the block height or the block time to compare the lock time with
+func lockTimeOf(lockTime uint64, header BlockHeader) uint64 {
+	if lockTime < LockTimeThreshold {
+		return header.Number
+	}
+	return header.Time
+}
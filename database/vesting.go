@@ -0,0 +1,61 @@
+package database
+
+import "fmt"
+
+// Vesting locks part of a genesis balance until the given block heights.
+// Nothing unlocks before Cliff, then the amount unlocks linearly from Start until
+// everything is spendable at End. A pure cliff has Cliff == End.
+type Vesting struct {
+	Locked Amount `json:"locked"`
+	Start  uint64 `json:"start"`
+	Cliff  uint64 `json:"cliff"`
+	End    uint64 `json:"end"`
+}
+
+func (v Vesting) validate() error {
+	if v.Start > v.End {
+		return fmt.Errorf("vesting start %d is after its end %d", v.Start, v.End)
+	}
+	if v.Cliff > v.End {
+		return fmt.Errorf("vesting cliff %d is after its end %d", v.Cliff, v.End)
+	}
+	return nil
+}
+
+// LockedAt returns how much of the vested amount is still locked at the given block height
+func (v Vesting) LockedAt(height uint64) Amount {
+	if height < v.Cliff || height < v.Start {
+		return v.Locked
+	}
+	if height >= v.End {
+		return 0
+	}
+
+	// height - Start < End - Start so the unlocked amount never exceeds Locked
+	unlocked, _ := v.Locked.MulDiv(height-v.Start, v.End-v.Start)
+	return v.Locked - unlocked
+}
+
+// spendable is the part of the account's balance not locked by vesting at the given height
+func (s *State) spendable(account Account, height uint64) Amount {
+	balance := s.Balances[account]
+	v, ok := s.vesting[account]
+	if !ok {
+		return balance
+	}
+
+	locked := v.LockedAt(height)
+	if locked >= balance {
+		return 0
+	}
+	return balance - locked
+}
+
+// SpendableBalances returns every account's balance minus what is still locked in the next block
+func (s *State) SpendableBalances() map[Account]Amount {
+	spendable := make(map[Account]Amount)
+	for account := range s.Balances {
+		spendable[account] = s.spendable(account, s.NextBlockNumber())
+	}
+	return spendable
+}
@@ -0,0 +1,221 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+)
+
+// Bodies are downloaded in ranges of bodyBatchSize blocks, at most maxParallelDownloads at once
+const bodyBatchSize = 20
+const maxParallelDownloads = 4
+
+// A peer slower than this loses its range to the next peer
+var syncClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchHeadersFromPeer asks for the headers following the last locator block the peer has
+func fetchHeadersFromPeer(peer PeerNode, locator []database.Hash, limit int) (HeadersRes, error) {
+	hashes := make([]string, 0, len(locator))
+	for _, hash := range locator {
+		hashes = append(hashes, hash.Hex())
+	}
+
+	url := fmt.Sprintf(
+		"http://%s%s?%s=%s&%s=%d",
+		peer.TcpAddress(),
+		endPointHeaders,
+		endpointHeadersQueryKeyLocator,
+		strings.Join(hashes, ","),
+		endpointSyncQueryLimit,
+		limit,
+	)
+
+	res, err := syncClient.Get(url)
+	if err != nil {
+		return HeadersRes{}, err
+	}
+
+	headersRes := HeadersRes{}
+	err = readRes(res, &headersRes)
+	if err != nil {
+		return HeadersRes{}, err
+	}
+	return headersRes, nil
+}
+
+func fetchBlocksByNumberFromPeer(peer PeerNode, from uint64, to uint64) ([]database.Block, error) {
+	url := fmt.Sprintf(
+		"http://%s%s?%s=%d&%s=%d",
+		peer.TcpAddress(),
+		endPointBlocks,
+		endpointBlocksQueryKeyFrom,
+		from,
+		endpointBlocksQueryKeyTo,
+		to,
+	)
+
+	res, err := syncClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusGone {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: peer %s pruned the requested blocks, fetch them from an archive node", database.ErrBlockPruned, peer.TcpAddress())
+	}
+
+	blocksRes := BlocksRes{}
+	err = readRes(res, &blocksRes)
+	if err != nil {
+		return nil, err
+	}
+	return blocksRes.Blocks, nil
+}
+
+// checkHeaderChain verifies the headers follow each other, starting right after the parent block.
+// Without a parent block they start at the first block.
+func checkHeaderChain(parent database.Hash, headers []database.BlockHeaderFS) error {
+	for i, h := range headers {
+		if i == 0 {
+			if parent.IsEmpty() && h.Header.Number != 0 {
+				return fmt.Errorf("header #%d has no parent block, expected the first block", h.Header.Number)
+			}
+			if !parent.IsEmpty() && h.Header.Parent != parent {
+				return fmt.Errorf("header #%d parent '%x' is not our latest block '%x'", h.Header.Number, h.Header.Parent, parent)
+			}
+			continue
+		}
+
+		prev := headers[i-1]
+		if h.Header.Number != prev.Header.Number+1 {
+			return fmt.Errorf("header #%d follows header #%d", h.Header.Number, prev.Header.Number)
+		}
+		if h.Header.Parent != prev.Key {
+			return fmt.Errorf("header #%d parent '%x' does not match previous header '%x'", h.Header.Number, h.Header.Parent, prev.Key)
+		}
+	}
+	return nil
+}
+
+// verifyBodies checks each block hashes to its header
+func verifyBodies(headers []database.BlockHeaderFS, blocks []database.Block) error {
+	if len(blocks) != len(headers) {
+		return fmt.Errorf("%w: expected %d blocks, got %d", errBodiesMismatch, len(headers), len(blocks))
+	}
+	for i, b := range blocks {
+		hash, err := b.Hash()
+		if err != nil {
+			return err
+		}
+		if hash != headers[i].Key || b.Header != headers[i].Header {
+			return fmt.Errorf("%w: block #%d '%x' does not match its header '%x'", errBodiesMismatch, b.Header.Number, hash, headers[i].Key)
+		}
+	}
+	return nil
+}
+
+// bodyPeers lists the peers to download bodies from, the peer that served the headers first.
+// The other peers of the sync round are skipped if their status shows them on another fork.
+func (n *Node) bodyPeers(headersPeer peerStatus, candidates []peerStatus, headers []database.BlockHeaderFS) []peerStatus {
+	byNumber := make(map[uint64]database.Hash)
+	for _, h := range headers {
+		byNumber[h.Header.Number] = h.Key
+	}
+
+	peers := []peerStatus{headersPeer}
+	for _, c := range candidates {
+		addr := c.peer.TcpAddress()
+		if addr == headersPeer.peer.TcpAddress() || addr == n.TcpAddress() || !n.isUsable(c.peer) {
+			continue
+		}
+		// A tip among the headers must be one of them
+		if hash, ok := byNumber[c.status.Number]; ok && hash != c.status.Hash {
+			continue
+		}
+		peers = append(peers, c)
+	}
+	return peers
+}
+
+// downloadBodies fetches the blocks of the headers in parallel ranges spread over the peers,
+// the first of which served the headers. A range that fails or doesn't match its headers is
+// retried with the next peer.
+func (n *Node) downloadBodies(headers []database.BlockHeaderFS, peers []peerStatus) ([]database.Block, error) {
+	ranges := make([][]database.BlockHeaderFS, 0)
+	for i := 0; i < len(headers); i += bodyBatchSize {
+		end := i + bodyBatchSize
+		if end > len(headers) {
+			end = len(headers)
+		}
+		ranges = append(ranges, headers[i:end])
+	}
+
+	results := make([][]database.Block, len(ranges))
+	errs := make([]error, len(ranges))
+	slots := make(chan struct{}, maxParallelDownloads)
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r []database.BlockHeaderFS) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i], errs[i] = n.downloadRange(r, peers, i)
+		}(i, r)
+	}
+	wg.Wait()
+
+	blocks := make([]database.Block, 0, len(headers))
+	for i := range ranges {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		blocks = append(blocks, results[i]...)
+	}
+	return blocks, nil
+}
+
+// downloadRange tries the peers whose chain reaches the range in turn, starting with the first-th one
+func (n *Node) downloadRange(headers []database.BlockHeaderFS, peers []peerStatus, first int) ([]database.Block, error) {
+	from := headers[0].Header.Number
+	to := headers[len(headers)-1].Header.Number
+
+	err := fmt.Errorf("no peer is at block #%d", to)
+	for j := 0; j < len(peers); j++ {
+		c := peers[(first+j)%len(peers)]
+		if c.status.Number < to {
+			continue
+		}
+		peer := c.peer
+
+		var blocks []database.Block
+		blocks, err = fetchBlocksByNumberFromPeer(peer, from, to)
+		if err != nil {
+			log.Printf("Failed to download blocks #%d-#%d from peer %s. Err: %s\n", from, to, peer.TcpAddress(), err)
+			n.penalizePeer(peer, err)
+			continue
+		}
+
+		err = verifyBodies(headers, blocks)
+		if err != nil && peer.TcpAddress() != peers[0].peer.TcpAddress() {
+			// Only the headers peer vouched for these blocks, another peer may just be behind or on a fork
+			log.Printf("Peer %s doesn't have blocks #%d-#%d. Err: %s\n", peer.TcpAddress(), from, to, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Headers peer %s served blocks #%d-#%d not matching its headers. Err: %s\n", peer.TcpAddress(), from, to, err)
+			n.penalizePeer(peer, fmt.Errorf("%w: %s", errInvalidBlocks, err.Error()))
+			continue
+		}
+
+		log.Printf("Downloaded blocks #%d-#%d from peer %s\n", from, to, peer.TcpAddress())
+		n.rewardPeer(peer)
+		return blocks, nil
+	}
+	return nil, fmt.Errorf("%w: no peer served blocks #%d-#%d. %s", errBodiesUnavailable, from, to, err)
+}
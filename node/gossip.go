@@ -0,0 +1,335 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+)
+
+const endPointAnnounceBlock = "/node/block"
+const endPointAnnounceTx = "/node/tx"
+const endPointMempool = "/node/mempool"
+
+// Hashes announced more than seenTTL ago are forgotten
+const seenTTL = 10 * time.Minute
+
+var gossipClient = &http.Client{Timeout: 5 * time.Second}
+
+// BlockAnnounceReq pushes a new block to a peer. Peer is the announcing node's address,
+// it must be on the host the request comes from.
+type BlockAnnounceReq struct {
+	Peer  string         `json:"peer"`
+	Block database.Block `json:"block"`
+}
+
+// TxAnnounceReq pushes a new tx to a peer. Peer is the announcing node's address,
+// it must be on the host the request comes from.
+type TxAnnounceReq struct {
+	Peer string      `json:"peer"`
+	Tx   database.Tx `json:"tx"`
+}
+
+type MempoolRes struct {
+	Txs []database.Tx `json:"txs"`
+}
+
+type AnnounceRes struct {
+	// False if the block or tx was already seen, or the block doesn't extend our chain yet
+	Accepted bool `json:"accepted"`
+}
+
+// seenCache remembers the hashes of the blocks and txs already gossiped,
+// so each one is only processed and relayed once
+type seenCache struct {
+	mu     sync.Mutex
+	hashes map[database.Hash]time.Time
+}
+
+func newSeenCache() *seenCache {
+	return &seenCache{hashes: make(map[database.Hash]time.Time)}
+}
+
+// add marks the hash as seen and returns false if it already was
+func (c *seenCache) add(hash database.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for h, seenAt := range c.hashes {
+		if now.Sub(seenAt) > seenTTL {
+			delete(c.hashes, h)
+		}
+	}
+
+	if _, seen := c.hashes[hash]; seen {
+		return false
+	}
+	c.hashes[hash] = now
+	return true
+}
+
+// has tells if the hash was seen less than seenTTL ago
+func (c *seenCache) has(hash database.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seenAt, seen := c.hashes[hash]
+	return seen && time.Since(seenAt) <= seenTTL
+}
+
+// announceBlock pushes the block to every known peer except the one it came from
+func (n *Node) announceBlock(b database.Block, from string) {
+	hash, err := b.Hash()
+	if err != nil {
+		log.Printf("Error while hashing announced block. Err: %s\n", err)
+		return
+	}
+	n.seen.add(hash)
+	n.broadcast(endPointAnnounceBlock, BlockAnnounceReq{n.TcpAddress(), b}, from)
+}
+
+// announceTx pushes the tx to every known peer except the one it came from
+func (n *Node) announceTx(tx database.Tx, from string) {
+	hash, err := tx.Hash()
+	if err != nil {
+		log.Printf("Error while hashing announced tx. Err: %s\n", err)
+		return
+	}
+	n.seen.add(hash)
+	n.broadcast(endPointAnnounceTx, TxAnnounceReq{n.TcpAddress(), tx}, from)
+}
+
+func (n *Node) broadcast(endPoint string, req interface{}, from string) {
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("Error while encoding announcement. Err: %s\n", err)
+		return
+	}
+
+	for _, peer := range n.Peers() {
+		if peer.TcpAddress() == from || peer.TcpAddress() == n.TcpAddress() {
+			continue
+		}
+
+		go func(peer PeerNode) {
+			res, err := gossipClient.Post(fmt.Sprintf("http://%s%s", peer.TcpAddress(), endPoint), "application/json", bytes.NewReader(reqJson))
+			if err != nil {
+				log.Printf("Error while announcing to peer %s. Err: %s\n", peer.TcpAddress(), err)
+				return
+			}
+			announceRes := AnnounceRes{}
+			err = readRes(res, &announceRes)
+			if err != nil {
+				log.Printf("Peer %s refused announcement. Err: %s\n", peer.TcpAddress(), err)
+			}
+		}(peer)
+	}
+}
+
+// receiveBlock adds a block announced by a peer if it extends our chain.
+// A block further ahead means we are behind, so a sync is started instead.
+// The block is only marked as seen once added, so a later announcement can still add it.
+func (n *Node) receiveBlock(b database.Block) (bool, error) {
+	hash, err := b.Hash()
+	if err != nil {
+		return false, err
+	}
+	if n.seen.has(hash) {
+		return false, nil
+	}
+
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+
+	next := n.state.NextBlockNumber()
+	if b.Header.Number > next {
+		log.Printf("Announced block #%d is ahead of our next block #%d. Syncing\n", b.Header.Number, next)
+		n.requestSync()
+		return false, nil
+	}
+	if b.Header.Number < next {
+		return false, nil
+	}
+	if b.Header.Parent != n.state.LatestBlockHash() {
+		log.Printf("Announced block #%d is on another fork. Syncing\n", b.Header.Number)
+		n.requestSync()
+		return false, nil
+	}
+
+	_, err = n.state.AddBlock(b)
+	if err != nil {
+		return false, err
+	}
+	n.seen.add(hash)
+	n.markTxsSeen(b)
+	return true, nil
+}
+
+// markTxsSeen stops the txs of an added block from being relayed into the mempool again
+func (n *Node) markTxsSeen(b database.Block) {
+	for _, tx := range b.TXs {
+		hash, err := tx.Hash()
+		if err == nil {
+			n.seen.add(hash)
+		}
+	}
+}
+
+// receiveTx validates a tx announced by a peer and keeps it in the mempool.
+// Like blocks, the tx is only marked as seen once accepted.
+func (n *Node) receiveTx(tx database.Tx) (bool, error) {
+	hash, err := tx.Hash()
+	if err != nil {
+		return false, err
+	}
+	if n.seen.has(hash) {
+		return false, nil
+	}
+
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+
+	if n.state.IsPending(hash) {
+		return false, nil
+	}
+	err = n.state.AddTx(tx, n.nextBlockHeader())
+	if err != nil {
+		return false, err
+	}
+	n.seen.add(hash)
+	return true, nil
+}
+
+// announcingPeer returns the known peer an announcement came from. The address the
+// sender claims is only trusted if it resolves to the host the request comes from.
+func (n *Node) announcingPeer(r *http.Request, address string) (PeerNode, error) {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return PeerNode{}, err
+	}
+
+	peer, ok := n.Peers()[address]
+	if !ok {
+		return PeerNode{}, fmt.Errorf("'%s' is not a known peer", address)
+	}
+	if !isPeerHost(peer.IP, remoteIP) {
+		return PeerNode{}, fmt.Errorf("announcement for peer '%s' was sent from '%s'", address, remoteIP)
+	}
+	if n.isBanned(address) {
+		return PeerNode{}, fmt.Errorf("peer '%s' is banned", address)
+	}
+	return peer, nil
+}
+
+// isPeerHost tells if the peer's IP or host name resolves to the remote IP
+func isPeerHost(peerIP string, remoteIP string) bool {
+	remote := net.ParseIP(remoteIP)
+	if remote == nil {
+		return false
+	}
+	ips, err := net.LookupIP(peerIP)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncMempool pulls the pending txs of a peer, so txs announced while we were away still reach us
+func (n *Node) syncMempool(peer PeerNode) error {
+	res, err := gossipClient.Get(fmt.Sprintf("http://%s%s", peer.TcpAddress(), endPointMempool))
+	if err != nil {
+		return err
+	}
+
+	mempoolRes := MempoolRes{}
+	err = readRes(res, &mempoolRes)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range mempoolRes.Txs {
+		accepted, err := n.receiveTx(tx)
+		if err != nil {
+			log.Printf("Ignoring pending tx from peer %s. Err: %s\n", peer.TcpAddress(), err)
+			continue
+		}
+		if accepted {
+			n.announceTx(tx, peer.TcpAddress())
+		}
+	}
+	return nil
+}
+
+func mempoolHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	n.stateMu.Lock()
+	txs := n.state.PendingTxs()
+	n.stateMu.Unlock()
+	writeRes(w, MempoolRes{txs})
+}
+
+func announceBlockHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	req := BlockAnnounceReq{}
+	err := readReq(r, &req)
+	if err != nil {
+		writeErrResWithStatus(w, err, http.StatusBadRequest)
+		return
+	}
+	peer, err := n.announcingPeer(r, req.Peer)
+	if err != nil {
+		writeErrResWithStatus(w, err, http.StatusForbidden)
+		return
+	}
+
+	accepted, err := n.receiveBlock(req.Block)
+	if errors.Is(err, database.ErrInvalidBlock) {
+		n.penalizePeer(peer, fmt.Errorf("%w: %s", errInvalidBlocks, err.Error()))
+		writeErrResWithStatus(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	if accepted {
+		log.Printf("Added block #%d announced by %s\n", req.Block.Header.Number, req.Peer)
+		n.announceBlock(req.Block, req.Peer)
+	}
+	writeRes(w, AnnounceRes{accepted})
+}
+
+func announceTxHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	req := TxAnnounceReq{}
+	err := readReq(r, &req)
+	if err != nil {
+		writeErrResWithStatus(w, err, http.StatusBadRequest)
+		return
+	}
+	_, err = n.announcingPeer(r, req.Peer)
+	if err != nil {
+		writeErrResWithStatus(w, err, http.StatusForbidden)
+		return
+	}
+
+	accepted, err := n.receiveTx(req.Tx)
+	if err != nil {
+		writeErrResWithStatus(w, err, http.StatusBadRequest)
+		return
+	}
+	if accepted {
+		n.announceTx(req.Tx, req.Peer)
+	}
+	writeRes(w, AnnounceRes{accepted})
+}
@@ -29,6 +29,12 @@ func readRes(r *http.Response, reqBody interface{}) error {
 
 	defer r.Body.Close()
 
+	if r.StatusCode != http.StatusOK {
+		errRes := ErrRes{}
+		json.Unmarshal(reqBodyJson, &errRes)
+		return fmt.Errorf("request failed with status %d: %s", r.StatusCode, errRes.Error)
+	}
+
 	err = json.Unmarshal(reqBodyJson, reqBody)
 	if err != nil {
 		return fmt.Errorf("unable to unmarshal response body. %s", err.Error())
@@ -49,8 +55,12 @@ func writeRes(w http.ResponseWriter, content interface{}) {
 }
 
 func writeErrRes(w http.ResponseWriter, err error) {
+	writeErrResWithStatus(w, err, http.StatusInternalServerError)
+}
+
+func writeErrResWithStatus(w http.ResponseWriter, err error, status int) {
 	jsonErrResponse, _ := json.Marshal(ErrRes{err.Error()})
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
 	w.Write(jsonErrResponse)
 }
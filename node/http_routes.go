@@ -1,24 +1,41 @@
 package node
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/harshrpg/go-blockchain-tut/database"
 )
 
 type TxAddReq struct {
-	From  string `json:"from"`
-	To    string `json:"string"`
-	Value uint   `json:"value"`
-	Data  string `json:"data"`
+	From       string             `json:"from"`
+	To         string             `json:"string"`
+	Value      database.Amount    `json:"value"` // in TOK, up to database.Decimals decimal places
+	Data       string             `json:"data"`
+	ValidAfter uint64             `json:"valid_after"`
+	ValidUntil uint64             `json:"valid_until"`
+	Kind       string             `json:"kind"`
+	Asset      string             `json:"asset"`
+	Owner      string             `json:"owner"` // transfer_from only
+	Escrow     *database.EscrowTx `json:"escrow"`
+	GasPrice   database.Amount    `json:"gas_price"`
+	// Multisig accounts only
+	Nonce      uint64                    `json:"nonce"`
+	Signatures []database.Signature      `json:"signatures"`
+	Multisig   *database.MultisigAccount `json:"multisig"`
 }
 
 type TxAddRes struct {
-	Hash database.Hash `json:"block_hash"`
+	Hash   database.Hash `json:"block_hash"`
+	TxHash database.Hash `json:"tx_hash"`
+	// The tx waits in the mempool until its validity window opens
+	Pending bool `json:"pending"`
 }
 
 type ErrRes struct {
@@ -26,18 +43,86 @@ type ErrRes struct {
 }
 
 type BalancesRes struct {
-	Hash     database.Hash             `json:"block_hash"`
-	Balances map[database.Account]uint `json:"balances"`
+	Hash     database.Hash                        `json:"block_hash"`
+	Asset    string                               `json:"asset"`
+	Balances map[database.Account]database.Amount `json:"balances"`
+	// Balances minus what is still locked by genesis vesting
+	Spendable map[database.Account]database.Amount `json:"spendable"`
+}
+
+type SupplyRes struct {
+	Hash        database.Hash   `json:"block_hash"`
+	Minted      database.Amount `json:"minted"`
+	Burned      database.Amount `json:"burned"`
+	Circulating database.Amount `json:"circulating"`
+	MaxSupply   database.Amount `json:"max_supply"` // 0 when uncapped
+}
+
+type AllowancesRes struct {
+	Hash    database.Hash    `json:"block_hash"`
+	Account database.Account `json:"account"`
+	// What each spender may still move from the account
+	Granted map[database.Account]database.Amount `json:"granted"`
+	// What the account may still move from each owner
+	Received map[database.Account]database.Amount `json:"received"`
+}
+
+type EscrowsRes struct {
+	Hash    database.Hash     `json:"block_hash"`
+	Escrows []database.Escrow `json:"escrows"`
+}
+
+type ContractsRes struct {
+	Hash      database.Hash       `json:"block_hash"`
+	Contracts []database.Contract `json:"contracts"`
+}
+
+type ReceiptsRes struct {
+	Receipts []database.Receipt `json:"receipts"`
+}
+
+type LogsRes struct {
+	Logs []database.Log `json:"logs"`
+}
+
+type TokensRes struct {
+	Hash   database.Hash    `json:"block_hash"`
+	Tokens []database.Token `json:"tokens"`
 }
 
 type StatusRes struct {
-	Hash       database.Hash       `json:"block_hash"`
-	Number     uint64              `json:"block_number"`
-	KnownPeers map[string]PeerNode `json:"peers_known"` // tell me all your peers
+	Hash        database.Hash       `json:"block_hash"`
+	Number      uint64              `json:"block_number"`
+	ChainID     string              `json:"chain_id"`
+	GenesisHash database.Hash       `json:"genesis_hash"`
+	KnownPeers  map[string]PeerNode `json:"peers_known"` // tell me all your peers
+	// Peer this node last synced blocks from
+	BestPeer string `json:"best_peer,omitempty"`
 }
 
 type SyncRes struct {
 	Blocks []database.Block `json:"blocks"`
+	// More blocks follow, ask for the ones after Next
+	More bool          `json:"more"`
+	Next database.Hash `json:"next"`
+}
+
+type HeadersRes struct {
+	// Last block of the locator we have, the headers follow it
+	Ancestor database.Hash            `json:"ancestor"`
+	Headers  []database.BlockHeaderFS `json:"headers"`
+	// More headers follow, ask for the ones after Next
+	More bool          `json:"more"`
+	Next database.Hash `json:"next"`
+}
+
+type BlocksRes struct {
+	Blocks []database.Block `json:"blocks"`
+}
+
+type SnapshotRes struct {
+	Snapshot database.Snapshot        `json:"snapshot"`
+	Headers  []database.BlockHeaderFS `json:"headers"`
 }
 
 type AddPeerRes struct {
@@ -46,15 +131,20 @@ type AddPeerRes struct {
 }
 
 func statusHandler(rw http.ResponseWriter, r *http.Request, n *Node) {
+	hash, header := n.latestBlock()
+	chainID, genesisHash := n.chain()
 	res := StatusRes{
-		Hash:       n.state.LatestBlockHash(),
-		Number:     n.state.LatestBlock().Header.Number,
-		KnownPeers: n.knownPeers,
+		Hash:        hash,
+		Number:      header.Number,
+		ChainID:     chainID,
+		GenesisHash: genesisHash,
+		KnownPeers:  n.Peers(),
+		BestPeer:    n.BestPeer(),
 	}
 	writeRes(rw, res)
 }
 
-func txAddHandler(w http.ResponseWriter, r *http.Request, state *database.State) {
+func txAddHandler(w http.ResponseWriter, r *http.Request, n *Node) {
 	req := TxAddReq{}
 	err := readReq(r, &req)
 	if err != nil {
@@ -63,25 +153,189 @@ func txAddHandler(w http.ResponseWriter, r *http.Request, state *database.State)
 	}
 
 	tx := database.NewTx(database.NewAccount(req.From), database.NewAccount(req.To), req.Value, req.Data)
+	tx.ValidAfter = req.ValidAfter
+	tx.ValidUntil = req.ValidUntil
+	tx.Kind = req.Kind
+	tx.Asset = req.Asset
+	tx.Owner = database.NewAccount(req.Owner)
+	tx.Escrow = req.Escrow
+	tx.GasPrice = req.GasPrice
+	tx.Nonce = req.Nonce
+	tx.Signatures = req.Signatures
+	tx.Multisig = req.Multisig
+	txHash, err := tx.Hash()
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	n.stateMu.Lock()
+	err = n.state.AddTx(tx, n.nextBlockHeader())
+	n.stateMu.Unlock()
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	n.announceTx(tx, "")
+
+	hash, err := n.produceBlock()
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	n.stateMu.Lock()
+	pending := n.state.IsPending(txHash)
+	n.stateMu.Unlock()
+	if pending {
+		writeRes(w, TxAddRes{TxHash: txHash, Pending: true})
+		return
+	}
+	writeRes(w, TxAddRes{hash, txHash, false})
+}
+
+func listBalancesHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	asset := r.URL.Query().Get(endpointBalancesQueryKeyAsset)
+	if asset == "" {
+		asset = database.NativeAsset
+	}
+
+	n.stateMu.Lock()
+	hash := n.state.LatestBlockHash()
+	balances, err := n.state.AssetBalances(asset)
+	// Vesting only locks TOK
+	spendable := balances
+	if asset == database.NativeAsset {
+		spendable = n.state.SpendableBalances()
+	}
+	n.stateMu.Unlock()
+
+	if err != nil {
+		writeErrResWithStatus(w, err, http.StatusNotFound)
+		return
+	}
+	writeRes(w, BalancesRes{hash, asset, balances, spendable})
+}
+
+func supplyHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	n.stateMu.Lock()
+	supply := n.state.Supply()
+	res := SupplyRes{n.state.LatestBlockHash(), supply.Minted, supply.Burned, supply.Circulating(), n.state.MaxSupply()}
+	n.stateMu.Unlock()
+	writeRes(w, res)
+}
+
+// accountsHandler serves /accounts/{addr}/allowances
+func accountsHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, endPointAccounts), "/")
+	if len(path) != 2 || path[0] == "" || path[1] != endPointAccountsAllowances {
+		writeErrResWithStatus(w, fmt.Errorf("unknown path '%s'", r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	account := database.NewAccount(path[0])
+	n.stateMu.Lock()
+	res := AllowancesRes{
+		Hash:     n.state.LatestBlockHash(),
+		Account:  account,
+		Granted:  n.state.AllowancesGranted(account),
+		Received: n.state.AllowancesReceived(account),
+	}
+	n.stateMu.Unlock()
+	writeRes(w, res)
+}
+
+// txHandler serves /tx/{hash}/receipt and /tx/{hash}/receipts
+func txHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, endPointTx), "/")
+	if len(path) != 2 || path[0] == "" || (path[1] != endPointTxReceipt && path[1] != endPointTxReceipts) {
+		writeErrResWithStatus(w, fmt.Errorf("unknown path '%s'", r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	txHash := database.Hash{}
+	err := txHash.UnmarshalText([]byte(path[0]))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	if path[1] == endPointTxReceipts {
+		receipts, err := database.GetReceipts(txHash, node.dataDir)
+		if err != nil {
+			writeErrRes(w, err)
+			return
+		}
+		writeRes(w, ReceiptsRes{receipts})
+		return
+	}
+
+	receipt, err := database.GetReceipt(txHash, node.dataDir)
+	if errors.Is(err, database.ErrReceiptNotFound) {
+		writeErrResWithStatus(w, err, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrReceiptAmbiguous) {
+		writeErrResWithStatus(w, fmt.Errorf("%s, see %s%x/%s", err.Error(), endPointTx, txHash, endPointTxReceipts), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, receipt)
+}
 
-	block := database.NewBlock(
-		state.LatestBlockHash(),
-		state.NextBlockNumber(),
-		uint64(time.Now().Unix()),
-		[]database.Tx{tx},
-	)
+// logsHandler serves /logs?account=..&from=..&to=.., the block range is inclusive
+func logsHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	filter := database.LogFilter{
+		Account: database.NewAccount(r.URL.Query().Get(endpointLogsQueryKeyAccount)),
+		ToBlock: math.MaxUint64,
+	}
+
+	var err error
+	if from := r.URL.Query().Get(endpointLogsQueryKeyFrom); from != "" {
+		filter.FromBlock, err = strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			writeErrRes(w, err)
+			return
+		}
+	}
+	if to := r.URL.Query().Get(endpointLogsQueryKeyTo); to != "" {
+		filter.ToBlock, err = strconv.ParseUint(to, 10, 64)
+		if err != nil {
+			writeErrRes(w, err)
+			return
+		}
+	}
 
-	hash, err := state.AddBlock(block)
+	logs, err := database.GetLogs(filter, node.dataDir)
 	if err != nil {
 		writeErrRes(w, err)
 		return
 	}
+	writeRes(w, LogsRes{logs})
+}
 
-	writeRes(w, TxAddRes{hash})
+func listContractsHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	n.stateMu.Lock()
+	res := ContractsRes{n.state.LatestBlockHash(), n.state.Contracts()}
+	n.stateMu.Unlock()
+	writeRes(w, res)
 }
 
-func listBalancesHandler(w http.ResponseWriter, r *http.Request, state *database.State) {
-	writeRes(w, BalancesRes{state.LatestBlockHash(), state.Balances})
+func listEscrowsHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	n.stateMu.Lock()
+	res := EscrowsRes{n.state.LatestBlockHash(), n.state.Escrows()}
+	n.stateMu.Unlock()
+	writeRes(w, res)
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	n.stateMu.Lock()
+	res := TokensRes{n.state.LatestBlockHash(), n.state.Tokens()}
+	n.stateMu.Unlock()
+	writeRes(w, res)
 }
 
 func syncHandler(rw http.ResponseWriter, r *http.Request, node *Node) {
@@ -94,13 +348,138 @@ func syncHandler(rw http.ResponseWriter, r *http.Request, node *Node) {
 		return
 	}
 
-	blocks, err := database.GetBlocksAfter(hash, node.dataDir)
+	limit, err := syncLimit(r)
+	if err != nil {
+		writeErrResWithStatus(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	blocks, more, err := database.GetBlocksAfter(hash, limit, node.dataDir)
+	if errors.Is(err, database.ErrBlockPruned) {
+		log.Println("Requested blocks were pruned. Peer should sync from an archive node")
+		writeErrResWithStatus(rw, err, http.StatusGone)
+		return
+	}
+	if errors.Is(err, database.ErrUnknownBlock) {
+		writeErrResWithStatus(rw, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErrRes(rw, err)
+		return
+	}
+
+	syncRes := SyncRes{Blocks: blocks, More: more, Next: hash}
+	if len(blocks) > 0 {
+		syncRes.Next, err = blocks[len(blocks)-1].Hash()
+		if err != nil {
+			writeErrRes(rw, err)
+			return
+		}
+	}
+	writeRes(rw, syncRes)
+}
+
+// syncLimit reads the limit query param, capped at maxSyncBlocks
+func syncLimit(r *http.Request) (int, error) {
+	limit := maxSyncBlocks
+	if reqLimit := r.URL.Query().Get(endpointSyncQueryLimit); reqLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(reqLimit)
+		if err != nil || limit <= 0 {
+			return 0, fmt.Errorf("invalid limit '%s'", reqLimit)
+		}
+		if limit > maxSyncBlocks {
+			limit = maxSyncBlocks
+		}
+	}
+	return limit, nil
+}
+
+// headersHandler serves the headers after the last block of the locator that is part of our chain
+func headersHandler(rw http.ResponseWriter, r *http.Request, node *Node) {
+	locator := make([]database.Hash, 0)
+	if reqLocator := r.URL.Query().Get(endpointHeadersQueryKeyLocator); reqLocator != "" {
+		for _, reqHash := range strings.Split(reqLocator, ",") {
+			hash := database.Hash{}
+			err := hash.UnmarshalText([]byte(reqHash))
+			if err != nil {
+				writeErrResWithStatus(rw, err, http.StatusBadRequest)
+				return
+			}
+			locator = append(locator, hash)
+		}
+	}
+	limit, err := syncLimit(r)
+	if err != nil {
+		writeErrResWithStatus(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	ancestor, err := database.FindCommonAncestor(locator, node.dataDir)
+	if err != nil {
+		writeErrRes(rw, err)
+		return
+	}
+	headers, more, err := database.GetHeadersAfter(ancestor, limit, node.dataDir)
 	if err != nil {
 		writeErrRes(rw, err)
 		return
 	}
 
-	writeRes(rw, SyncRes{Blocks: blocks})
+	headersRes := HeadersRes{Ancestor: ancestor, Headers: headers, More: more, Next: ancestor}
+	if len(headers) > 0 {
+		headersRes.Next = headers[len(headers)-1].Key
+	}
+	writeRes(rw, headersRes)
+}
+
+func blocksHandler(rw http.ResponseWriter, r *http.Request, node *Node) {
+	from, err := strconv.ParseUint(r.URL.Query().Get(endpointBlocksQueryKeyFrom), 10, 64)
+	if err != nil {
+		writeErrResWithStatus(rw, err, http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseUint(r.URL.Query().Get(endpointBlocksQueryKeyTo), 10, 64)
+	if err != nil {
+		writeErrResWithStatus(rw, err, http.StatusBadRequest)
+		return
+	}
+	if to < from || to-from >= maxSyncBlocks {
+		writeErrResWithStatus(rw, fmt.Errorf("block range %d-%d must hold 1 to %d blocks", from, to, maxSyncBlocks), http.StatusBadRequest)
+		return
+	}
+
+	blocks, err := database.GetBlocksByNumber(from, to, node.dataDir)
+	if errors.Is(err, database.ErrBlockPruned) {
+		writeErrResWithStatus(rw, err, http.StatusGone)
+		return
+	}
+	if err != nil {
+		writeErrRes(rw, err)
+		return
+	}
+	writeRes(rw, BlocksRes{blocks})
+}
+
+func snapshotHandler(rw http.ResponseWriter, r *http.Request, node *Node) {
+	log.Println("Handling snapshot request for node")
+	// The snapshot and its headers are read together, before a fork switch can replace either
+	node.stateMu.Lock()
+	snap, err := database.LoadSnapshot(node.dataDir)
+	if err != nil {
+		node.stateMu.Unlock()
+		writeErrRes(rw, err)
+		return
+	}
+	headers, err := database.GetHeadersUpTo(snap.BlockHash, node.dataDir)
+	node.stateMu.Unlock()
+	if err != nil {
+		writeErrRes(rw, err)
+		return
+	}
+
+	writeRes(rw, SnapshotRes{snap, headers})
 }
 
 func addPeerHandler(rw http.ResponseWriter, r *http.Request, n *Node) {
@@ -117,10 +496,25 @@ func addPeerHandler(rw http.ResponseWriter, r *http.Request, n *Node) {
 		return
 	}
 	log.Println("Peer Port found")
+
+	peerChainID := r.URL.Query().Get(endpointAddPeerQueryKeyChainID)
+	peerGenesisHash := database.Hash{}
+	err = peerGenesisHash.UnmarshalText([]byte(r.URL.Query().Get(endpointAddPeerQueryKeyGenesisHash)))
+	if err != nil {
+		writeRes(rw, AddPeerRes{false, err.Error()})
+		return
+	}
+	err = n.checkSameChain(peerChainID, peerGenesisHash)
+	if err != nil {
+		log.Printf("Refusing peer %s:%d. Err: %s\n", peerIp, peerPort, err)
+		writeRes(rw, AddPeerRes{false, err.Error()})
+		return
+	}
 	log.Println("Creating a new Peer Node")
 	peer := NewPeerNode(peerIp, uint64(peerPort), false, true) // IMPROVEMENT: can fetch peer's activity from peer itself
 	log.Println("Adding peer to node")
 	n.AddPeer(peer)
+	n.setLastSeen(peer.TcpAddress(), time.Now())
 	fmt.Printf("Peer %s was addedd successfully to Known Peer's of this node", peer.TcpAddress())
 	writeRes(rw, AddPeerRes{true, ""})
 }
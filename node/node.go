@@ -1,23 +1,58 @@
 package node
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/harshrpg/go-blockchain-tut/database"
 )
 
 const DefaultIP = "127.0.0.1"
 const DefaultHTTPPort = 8080
+const endPointBalancesList = "/balances/list"
+const endpointBalancesQueryKeyAsset = "asset" // /balances/list?asset=GOLD
+const endPointTokensList = "/tokens/list"
+const endPointSupply = "/supply"
+const endPointAccounts = "/accounts/" // /accounts/{addr}/allowances
+const endPointAccountsAllowances = "allowances"
+const endPointEscrowsList = "/escrows/list"
+const endPointContractsList = "/contracts/list"
+const endPointTxAdd = "/tx/add"
+const endPointTx = "/tx/" // /tx/{hash}/receipt, /tx/{hash}/receipts for every block the tx was included in
+const endPointTxReceipt = "receipt"
+const endPointTxReceipts = "receipts"
+const endPointLogs = "/logs" // /logs?account=alice&from=10&to=20
+const endpointLogsQueryKeyAccount = "account"
+const endpointLogsQueryKeyFrom = "from"
+const endpointLogsQueryKeyTo = "to"
+
 const endPointStatus = "/node/status"
 const endPointSync = "/node/sync"
 const endpointSyncQueryFromBlock = "fromBlock" // /node/sync?fromBloc=0x913223...
+const endpointSyncQueryLimit = "limit"         // /node/sync?fromBlock=0x913223...&limit=100
+
+const endPointHeaders = "/node/headers" // /node/headers?locator=0x913223...,0x5a1b02...&limit=100
+const endpointHeadersQueryKeyLocator = "locator"
+const endPointBlocks = "/node/blocks" // /node/blocks?from=10&to=20
+const endpointBlocksQueryKeyFrom = "from"
+const endpointBlocksQueryKeyTo = "to"
+
+// Most blocks or headers served by a single sync response
+const maxSyncBlocks = 500
+
+const endPointSnapshot = "/node/snapshot"
 
 const endPointAddPeer = "/node/peer"
 const endPointAddPeerQueryKeyIP = "ip"
 const endpointAddPeerQueryKeyPort = "port"
+const endpointAddPeerQueryKeyChainID = "chain_id"
+const endpointAddPeerQueryKeyGenesisHash = "genesis_hash"
 
 type PeerNode struct {
 	IP          string `json:"ip"`
@@ -27,15 +62,42 @@ type PeerNode struct {
 	connected bool
 }
 
+const SyncModeFull = "full"
+const SyncModeSnapshot = "snapshot"
+
+// SyncConfig tells a fresh node how to catch up with its peers
+type SyncConfig struct {
+	Mode string
+	// A snapshot is only trusted if it is at or after this block
+	Checkpoint database.Hash
+	// A snapshot is only trusted if its state hashes to this root, required in snapshot mode
+	StateRoot database.Hash
+}
+
 type Node struct {
 	dataDir string
 	ip      string
 	port    uint64
+	syncCfg SyncConfig
+	// Bodies of blocks deeper than this are discarded, 0 keeps every block
+	pruneDepth uint64
 
 	// To inject the state into HTTP Handlers
 	state *database.State
+	// Serialises changes to the state between the HTTP handlers, sync and block production
+	stateMu sync.Mutex
 
 	knownPeers map[string]PeerNode
+	// Peer with the highest chain in the latest sync round
+	bestPeer string
+	// Behaviour of each peer, see PeerScore
+	scores  map[string]PeerScore
+	peersMu sync.RWMutex
+
+	// Blocks and txs already gossiped
+	seen *seenCache
+	// Asks the sync loop to sync right away, e.g. when a peer announced a block ahead of us
+	syncNow chan struct{}
 }
 
 func (pn PeerNode) TcpAddress() string {
@@ -43,15 +105,24 @@ func (pn PeerNode) TcpAddress() string {
 	return fmt.Sprintf("%s:%d", pn.IP, pn.Port)
 }
 
-func New(dataDir string, ip string, port uint64, bootstrap PeerNode) *Node {
+func New(dataDir string, ip string, port uint64, bootstraps []PeerNode, syncCfg SyncConfig, pruneDepth uint64) *Node {
 	log.Println("Crearing a new node")
 	knownPeers := make(map[string]PeerNode)
-	knownPeers[bootstrap.TcpAddress()] = bootstrap
+	scores := make(map[string]PeerScore)
+	for _, bootstrap := range bootstraps {
+		knownPeers[bootstrap.TcpAddress()] = bootstrap
+		scores[bootstrap.TcpAddress()] = PeerScore{LastSeen: time.Now()}
+	}
 	return &Node{
 		dataDir:    dataDir,
 		ip:         ip,
 		port:       port,
+		syncCfg:    syncCfg,
+		pruneDepth: pruneDepth,
 		knownPeers: knownPeers,
+		scores:     scores,
+		seen:       newSeenCache(),
+		syncNow:    make(chan struct{}, 1),
 	}
 }
 
@@ -73,16 +144,61 @@ func (n *Node) Run() error {
 	log.Println("State fetched and safely closed")
 	n.state = state
 
+	n.loadPeers()
+
+	if n.syncCfg.Mode == SyncModeSnapshot && state.LatestBlockHash().IsEmpty() {
+		err = n.syncSnapshot()
+		if err != nil {
+			return err
+		}
+	}
+
 	go n.sync(ctx)
+	go n.produce(ctx)
 
 	// listing all the balances
-	http.HandleFunc("/balances/list", func(w http.ResponseWriter, r *http.Request) {
-		listBalancesHandler(w, r, state)
+	http.HandleFunc(endPointBalancesList, func(w http.ResponseWriter, r *http.Request) {
+		listBalancesHandler(w, r, n)
+	})
+
+	// TOK minted, burned and in circulation
+	http.HandleFunc(endPointSupply, func(w http.ResponseWriter, r *http.Request) {
+		supplyHandler(w, r, n)
+	})
+
+	// Account details, e.g. allowances
+	http.HandleFunc(endPointAccounts, func(w http.ResponseWriter, r *http.Request) {
+		accountsHandler(w, r, n)
+	})
+
+	// listing the escrows not claimed or refunded yet
+	http.HandleFunc(endPointEscrowsList, func(w http.ResponseWriter, r *http.Request) {
+		listEscrowsHandler(w, r, n)
+	})
+
+	// listing the deployed contracts and their storage
+	http.HandleFunc(endPointContractsList, func(w http.ResponseWriter, r *http.Request) {
+		listContractsHandler(w, r, n)
+	})
+
+	// listing all the tokens issued on the chain
+	http.HandleFunc(endPointTokensList, func(w http.ResponseWriter, r *http.Request) {
+		listTokensHandler(w, r, n)
 	})
 
 	// Adding a new transaction
-	http.HandleFunc("/tx/add", func(w http.ResponseWriter, r *http.Request) {
-		txAddHandler(w, r, state)
+	http.HandleFunc(endPointTxAdd, func(w http.ResponseWriter, r *http.Request) {
+		txAddHandler(w, r, n)
+	})
+
+	// Receipts of included txs
+	http.HandleFunc(endPointTx, func(w http.ResponseWriter, r *http.Request) {
+		txHandler(w, r, n)
+	})
+
+	// Events emitted by txs, filtered by account and block range
+	http.HandleFunc(endPointLogs, func(w http.ResponseWriter, r *http.Request) {
+		logsHandler(w, r, n)
 	})
 
 	// Exposing current node's state
@@ -95,6 +211,37 @@ func (n *Node) Run() error {
 		syncHandler(rw, r, n)
 	})
 
+	// Headers first sync, the header chain then block bodies by height
+	http.HandleFunc(endPointHeaders, func(rw http.ResponseWriter, r *http.Request) {
+		headersHandler(rw, r, n)
+	})
+	http.HandleFunc(endPointBlocks, func(rw http.ResponseWriter, r *http.Request) {
+		blocksHandler(rw, r, n)
+	})
+
+	// Serving the latest state snapshot to fresh nodes
+	http.HandleFunc(endPointSnapshot, func(rw http.ResponseWriter, r *http.Request) {
+		snapshotHandler(rw, r, n)
+	})
+
+	// Blocks and txs pushed by peers
+	http.HandleFunc(endPointAnnounceBlock, func(rw http.ResponseWriter, r *http.Request) {
+		announceBlockHandler(rw, r, n)
+	})
+	http.HandleFunc(endPointAnnounceTx, func(rw http.ResponseWriter, r *http.Request) {
+		announceTxHandler(rw, r, n)
+	})
+
+	// Known peers with their scores and bans
+	http.HandleFunc(endPointPeers, func(rw http.ResponseWriter, r *http.Request) {
+		peersHandler(rw, r, n)
+	})
+
+	// Pending txs, pulled by peers while syncing
+	http.HandleFunc(endPointMempool, func(rw http.ResponseWriter, r *http.Request) {
+		mempoolHandler(rw, r, n)
+	})
+
 	// Adding a new peer
 	http.HandleFunc(endPointAddPeer, func(rw http.ResponseWriter, r *http.Request) {
 		log.Println("Received request to add a new peer")
@@ -104,22 +251,108 @@ func (n *Node) Run() error {
 	return http.ListenAndServe(fmt.Sprintf("%s:%d", n.ip, n.port), nil)
 }
 
+// SendTx submits a tx to the node listening at tcpAddress
+func SendTx(tcpAddress string, req TxAddReq) (TxAddRes, error) {
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return TxAddRes{}, err
+	}
+
+	res, err := http.Post(fmt.Sprintf("http://%s%s", tcpAddress, endPointTxAdd), "application/json", bytes.NewReader(reqJson))
+	if err != nil {
+		return TxAddRes{}, err
+	}
+
+	txAddRes := TxAddRes{}
+	err = readRes(res, &txAddRes)
+	if err != nil {
+		return TxAddRes{}, err
+	}
+	return txAddRes, nil
+}
+
+func (n *Node) TcpAddress() string {
+	return fmt.Sprintf("%s:%d", n.ip, n.port)
+}
+
 func (n *Node) AddPeer(peer PeerNode) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
 	n.knownPeers[peer.TcpAddress()] = peer
+	if ps := n.scores[peer.TcpAddress()]; ps.LastSeen.IsZero() {
+		ps.LastSeen = time.Now()
+		n.scores[peer.TcpAddress()] = ps
+	}
 }
 
 func (n *Node) RemovePeer(peer PeerNode) {
 	log.Printf("Removing Peer: %s\n", peer.TcpAddress())
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
 	delete(n.knownPeers, peer.TcpAddress())
+	delete(n.scores, peer.TcpAddress())
 	log.Println("Peer removed")
 }
 
+// Peers returns a copy of the known peers
+func (n *Node) Peers() map[string]PeerNode {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+	peers := make(map[string]PeerNode, len(n.knownPeers))
+	for addr, peer := range n.knownPeers {
+		peers[addr] = peer
+	}
+	return peers
+}
+
+func (n *Node) BestPeer() string {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+	return n.bestPeer
+}
+
+func (n *Node) setBestPeer(tcpAddress string) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	n.bestPeer = tcpAddress
+}
+
+func (n *Node) isKnownPeerAddress(tcpAddress string) bool {
+	_, ok := n.Peers()[tcpAddress]
+	return ok
+}
+
+// latestBlock returns the hash and header of our latest block
+func (n *Node) latestBlock() (database.Hash, database.BlockHeader) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.state.LatestBlockHash(), n.state.LatestBlock().Header
+}
+
+// chain returns the chain id and genesis hash of our chain
+func (n *Node) chain() (string, database.Hash) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+	return n.state.ChainID(), n.state.GenesisHash()
+}
+
+// checkSameChain refuses peers running a different chain than ours
+func (n *Node) checkSameChain(chainID string, genesisHash database.Hash) error {
+	ourChainID, ourGenesisHash := n.chain()
+	if chainID != ourChainID {
+		return fmt.Errorf("peer is on chain '%s', this node is on chain '%s'", chainID, ourChainID)
+	}
+	if genesisHash != ourGenesisHash {
+		return fmt.Errorf("peer genesis '%x' does not match this node's genesis '%x'", genesisHash, ourGenesisHash)
+	}
+	return nil
+}
+
 func (n *Node) IsKnownPeer(peer PeerNode) bool {
 	log.Println("Checking if the peer is known")
 	if peer.IP == n.ip && peer.Port == n.port {
 		return true
 	}
 
-	_, isKnownPeer := n.knownPeers[peer.TcpAddress()]
-	return isKnownPeer
+	return n.isKnownPeerAddress(peer.TcpAddress())
 }
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const peersFileName = "peers.json"
+
+// Peers not seen for peerMaxAge are forgotten, bootstrap peers are always kept
+const peerMaxAge = 24 * time.Hour
+
+type storedPeer struct {
+	Peer     PeerNode  `json:"peer"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (n *Node) peersFilePath() string {
+	return filepath.Join(n.dataDir, peersFileName)
+}
+
+// loadPeers adds the peers persisted by a previous run, skipping the stale ones.
+// The peers file is only a cache, the node starts from its bootstrap peers if it can't be read.
+func (n *Node) loadPeers() {
+	content, err := ioutil.ReadFile(n.peersFilePath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Ignoring the saved peers, %s can't be read. Err: %s\n", n.peersFilePath(), err)
+		return
+	}
+
+	stored := make(map[string]storedPeer)
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		log.Printf("Ignoring the saved peers, %s is corrupt. Err: %s\n", n.peersFilePath(), err)
+		return
+	}
+
+	loaded := 0
+	for addr, sp := range stored {
+		if time.Since(sp.LastSeen) > peerMaxAge {
+			log.Printf("Forgetting peer %s, last seen %s\n", addr, sp.LastSeen.Format(time.RFC3339))
+			continue
+		}
+		if _, known := n.Peers()[addr]; known {
+			n.setLastSeen(addr, sp.LastSeen)
+			loaded++
+			continue
+		}
+
+		// Only the peers passed on the command line are bootstrap peers
+		sp.Peer.IsBootstrap = false
+		n.setLastSeen(addr, sp.LastSeen)
+		n.AddPeer(sp.Peer)
+		loaded++
+	}
+	log.Printf("Loaded %d peers from %s\n", loaded, n.peersFilePath())
+}
+
+// persistPeers saves the known peers with the last time they answered us
+func (n *Node) persistPeers() error {
+	stored := make(map[string]storedPeer)
+	for addr, peer := range n.Peers() {
+		if addr == n.TcpAddress() {
+			continue
+		}
+		stored[addr] = storedPeer{peer, n.peerScore(addr).LastSeen}
+	}
+
+	storedJson, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to a tmp file first so a crash never leaves a partial peers file
+	tmpPath := n.peersFilePath() + ".tmp"
+	err = ioutil.WriteFile(tmpPath, storedJson, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, n.peersFilePath())
+}
+
+// ageOutPeers drops the peers that didn't answer for peerMaxAge
+func (n *Node) ageOutPeers() {
+	for addr, peer := range n.Peers() {
+		if peer.IsBootstrap {
+			continue
+		}
+		lastSeen := n.peerScore(addr).LastSeen
+		if time.Since(lastSeen) > peerMaxAge {
+			log.Printf("Peer %s was not seen since %s and was removed\n", addr, lastSeen.Format(time.RFC3339))
+			n.RemovePeer(peer)
+		}
+	}
+}
+
+func (n *Node) setLastSeen(tcpAddress string, lastSeen time.Time) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	ps := n.scores[tcpAddress]
+	ps.LastSeen = lastSeen
+	n.scores[tcpAddress] = ps
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+)
+
+const blockTime = 10 * time.Second
+
+// produce seals the valid mempool txs into a new block every blockTime,
+// so scheduled txs get included once their validity window opens
+func (n *Node) produce(ctx context.Context) {
+	ticker := time.NewTicker(blockTime)
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := n.produceBlock()
+			if err != nil {
+				log.Printf("Error while producing block. Err: %s\n", err)
+			}
+
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// produceBlock adds a block with every mempool tx valid right now.
+// It returns an empty hash if there was nothing to include.
+func (n *Node) produceBlock() (database.Hash, error) {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+
+	next := n.nextBlockHeader()
+	txs := n.state.NextBlockTxs(next)
+	if len(txs) == 0 {
+		return database.Hash{}, nil
+	}
+
+	log.Printf("Producing block #%d with %d txs\n", next.Number, len(txs))
+	block, err := database.NewBlock(next.Parent, next.Number, next.Time, txs)
+	if err != nil {
+		return database.Hash{}, err
+	}
+	block.Header.GasLimit = next.GasLimit
+	hash, err := n.state.AddBlock(block)
+	if err != nil {
+		return database.Hash{}, err
+	}
+
+	n.announceBlock(block, "")
+	return hash, nil
+}
+
+func (n *Node) nextBlockHeader() database.BlockHeader {
+	// A block can't be older than its parent, which a peer with a clock ahead of ours may have produced
+	now := uint64(time.Now().Unix())
+	if parentTime := n.state.LatestBlock().Header.Time; now < parentTime {
+		now = parentTime
+	}
+
+	return database.BlockHeader{
+		Parent:   n.state.LatestBlockHash(),
+		Number:   n.state.NextBlockNumber(),
+		Time:     now,
+		GasLimit: n.state.BlockGasLimit(),
+	}
+}
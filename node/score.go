@@ -0,0 +1,153 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"time"
+
+	"github.com/harshrpg/go-blockchain-tut/database"
+)
+
+const endPointPeers = "/node/peers"
+
+// Peers start at a score of 0, gain a point per good response up to scoreMax
+// and lose points on misbehaviour. At banThreshold they are banned for banDuration.
+const scoreMax = 100
+const banThreshold = -100
+const banDuration = 30 * time.Minute
+const penaltyTimeout = -5
+const penaltyBadResponse = -20
+const penaltyInvalidBlocks = -50
+
+// A failing peer is retried after retryBackoff, doubling with each consecutive failure up to maxRetryBackoff
+const retryBackoff = 30 * time.Second
+const maxRetryBackoff = 30 * time.Minute
+
+// errInvalidBlocks marks blocks or headers from a peer that failed validation
+var errInvalidBlocks = errors.New("invalid blocks")
+
+// errBodiesMismatch means a peer answered with blocks not matching the synced headers. Only the
+// peer that served the headers is at fault, others may be behind or on another fork.
+var errBodiesMismatch = errors.New("block bodies do not match their headers")
+
+// errBodiesUnavailable means no peer served some block bodies, each was already penalised
+var errBodiesUnavailable = errors.New("block bodies unavailable")
+
+// errLocalFailure marks errors of this node, e.g. failing to write synced blocks, the peer is not at fault
+var errLocalFailure = errors.New("local failure")
+
+// PeerScore tracks how well a peer behaved
+type PeerScore struct {
+	Score       int       `json:"score"`
+	Failures    int       `json:"failures"` // consecutive
+	RetryAt     time.Time `json:"retry_at"`
+	BannedUntil time.Time `json:"banned_until"`
+	// Last good response, or when the peer was learnt of if it never answered
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (ps PeerScore) banned(now time.Time) bool {
+	return now.Before(ps.BannedUntil)
+}
+
+type PeerInfo struct {
+	Peer PeerNode `json:"peer"`
+	PeerScore
+	Banned bool `json:"banned"`
+}
+
+type PeersRes struct {
+	Peers []PeerInfo `json:"peers"`
+}
+
+// peerScore returns the score of a peer, lifting an expired ban
+func (n *Node) peerScore(tcpAddress string) PeerScore {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	ps := n.scores[tcpAddress]
+	if !ps.BannedUntil.IsZero() && !ps.banned(time.Now()) {
+		log.Printf("Ban of peer %s expired\n", tcpAddress)
+		ps = PeerScore{LastSeen: ps.LastSeen}
+		n.scores[tcpAddress] = ps
+	}
+	return ps
+}
+
+// isUsable tells if the peer is neither banned nor waiting to be retried
+func (n *Node) isUsable(peer PeerNode) bool {
+	ps := n.peerScore(peer.TcpAddress())
+	now := time.Now()
+	return !ps.banned(now) && !now.Before(ps.RetryAt)
+}
+
+func (n *Node) isBanned(tcpAddress string) bool {
+	return n.peerScore(tcpAddress).banned(time.Now())
+}
+
+func (n *Node) rewardPeer(peer PeerNode) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	ps := n.scores[peer.TcpAddress()]
+	if ps.Score < scoreMax {
+		ps.Score++
+	}
+	ps.Failures = 0
+	ps.RetryAt = time.Time{}
+	ps.LastSeen = time.Now()
+	n.scores[peer.TcpAddress()] = ps
+}
+
+// penalizePeer lowers the peer score according to the error it caused and backs off from it
+func (n *Node) penalizePeer(peer PeerNode, err error) {
+	var urlErr *neturl.Error
+	penalty := penaltyBadResponse
+	switch {
+	case errors.Is(err, errBodiesUnavailable), errors.Is(err, database.ErrBlockPruned), errors.Is(err, errLocalFailure), errors.Is(err, errBodiesMismatch):
+		return
+	case errors.Is(err, errInvalidBlocks):
+		penalty = penaltyInvalidBlocks
+	case errors.As(err, &urlErr):
+		penalty = penaltyTimeout
+	}
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	now := time.Now()
+	ps := n.scores[peer.TcpAddress()]
+	ps.Score += penalty
+	ps.Failures++
+	backoff := retryBackoff
+	for i := 1; i < ps.Failures && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	ps.RetryAt = now.Add(backoff)
+
+	if ps.Score <= banThreshold && !ps.banned(now) {
+		ps.BannedUntil = now.Add(banDuration)
+		log.Printf("Banning peer %s until %s, score %d\n", peer.TcpAddress(), ps.BannedUntil.Format(time.RFC3339), ps.Score)
+	}
+	n.scores[peer.TcpAddress()] = ps
+	log.Printf("Peer %s scored %d (%d), retrying in %s. Err: %s\n", peer.TcpAddress(), ps.Score, penalty, backoff, err)
+}
+
+func peersHandler(w http.ResponseWriter, r *http.Request, n *Node) {
+	now := time.Now()
+	peers := make([]PeerInfo, 0)
+	for addr, peer := range n.Peers() {
+		ps := n.peerScore(addr)
+		peers = append(peers, PeerInfo{peer, ps, ps.banned(now)})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Peer.TcpAddress() < peers[j].Peer.TcpAddress()
+	})
+	writeRes(w, PeersRes{peers})
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// syncSnapshot bootstraps an empty node from the first peer serving a trusted snapshot.
+// Normal block sync continues from the snapshot block afterwards.
+func (n *Node) syncSnapshot() error {
+	// No block header commits to the state root, the snapshot is only as trusted as the configured root
+	if n.syncCfg.StateRoot.IsEmpty() {
+		return fmt.Errorf("snapshot sync requires a trusted state root")
+	}
+
+	for _, peer := range n.Peers() {
+		if n.ip == peer.IP && n.port == peer.Port {
+			continue
+		}
+
+		status, err := queryPeerStatus(peer)
+		if err != nil {
+			log.Printf("Unable to query peer %s. Err: %s\n", peer.TcpAddress(), err)
+			continue
+		}
+		err = n.checkSameChain(status.ChainID, status.GenesisHash)
+		if err != nil {
+			log.Printf("Peer %s is on another chain. Err: %s\n", peer.TcpAddress(), err)
+			continue
+		}
+
+		snapRes, err := fetchSnapshotFromPeer(peer)
+		if err != nil {
+			log.Printf("Unable to fetch snapshot from peer %s. Err: %s\n", peer.TcpAddress(), err)
+			continue
+		}
+
+		err = n.verifySnapshotTrust(snapRes)
+		if err != nil {
+			log.Printf("Rejecting snapshot from peer %s. Err: %s\n", peer.TcpAddress(), err)
+			continue
+		}
+
+		err = n.state.InstallSnapshot(snapRes.Snapshot, snapRes.Headers)
+		if err != nil {
+			log.Printf("Unable to install snapshot from peer %s. Err: %s\n", peer.TcpAddress(), err)
+			continue
+		}
+
+		log.Printf("Bootstrapped from snapshot at block #%d of peer %s\n", snapRes.Snapshot.Height, peer.TcpAddress())
+		return nil
+	}
+
+	return fmt.Errorf("no known peer served a trusted snapshot")
+}
+
+// verifySnapshotTrust checks the snapshot against the configured state root and checkpoint.
+// Internal consistency of the snapshot is verified when installing it.
+func (n *Node) verifySnapshotTrust(snapRes SnapshotRes) error {
+	if snapRes.Snapshot.StateRoot != n.syncCfg.StateRoot {
+		return fmt.Errorf("state root '%x' is not the trusted root '%x'", snapRes.Snapshot.StateRoot, n.syncCfg.StateRoot)
+	}
+
+	if n.syncCfg.Checkpoint.IsEmpty() {
+		return nil
+	}
+	for _, h := range snapRes.Headers {
+		if h.Key == n.syncCfg.Checkpoint {
+			return nil
+		}
+	}
+	return fmt.Errorf("header chain does not contain the trusted checkpoint '%x'", n.syncCfg.Checkpoint)
+}
+
+func fetchSnapshotFromPeer(peer PeerNode) (SnapshotRes, error) {
+	log.Printf("Fetching snapshot from Peer %s...\n", peer.TcpAddress())
+	url := fmt.Sprintf("http://%s%s", peer.TcpAddress(), endPointSnapshot)
+	res, err := http.Get(url)
+	if err != nil {
+		return SnapshotRes{}, err
+	}
+
+	snapRes := SnapshotRes{}
+	err = readRes(res, &snapRes)
+	if err != nil {
+		return SnapshotRes{}, err
+	}
+
+	return snapRes, nil
+}
@@ -2,14 +2,20 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"sort"
 	"time"
 
 	"github.com/harshrpg/go-blockchain-tut/database"
 )
 
+// Blocks asked from a peer per sync request
+const syncBatchSize = 100
+
 func (n *Node) sync(ctx context.Context) error {
 	tickerTimer := 45 * time.Second
 	log.Printf("Synching node at every: %x\n", tickerTimer)
@@ -20,6 +26,11 @@ func (n *Node) sync(ctx context.Context) error {
 		case <-ticker.C:
 			log.Println("Initializing sync")
 			n.doSync()
+			n.prune()
+
+		case <-n.syncNow:
+			log.Println("Sync requested")
+			n.doSync()
 
 		case <-ctx.Done():
 			ticker.Stop()
@@ -27,54 +38,129 @@ func (n *Node) sync(ctx context.Context) error {
 	}
 }
 
+// peerStatus is a peer together with the status it reported during a sync round
+type peerStatus struct {
+	peer   PeerNode
+	status StatusRes
+}
+
 func (n *Node) doSync() {
 	log.Println("Performing sync for node")
-	for i, peer := range n.knownPeers {
+	n.ageOutPeers()
+	candidates := make([]peerStatus, 0)
+	for i, peer := range n.Peers() {
 		log.Printf("Checking if known peer #%x is same as current node\n", i)
 		if n.ip == peer.IP && n.port == peer.Port {
 			continue // IMPROVEMENT: Refactor this loop
 		}
+		if !n.isUsable(peer) {
+			log.Printf("Skipping peer %s, it is banned or backing off\n", peer.TcpAddress())
+			continue
+		}
 		log.Printf("Searching for new Peers and their Blocks and Peers: %s\n", peer.TcpAddress())
 
 		status, err := queryPeerStatus(peer)
 		if err != nil {
 			log.Printf("Error occured: %s\n", err)
-			log.Printf("Peer %s was removed from this node's known Peers\n", peer.TcpAddress())
-			n.RemovePeer(peer)
+			n.penalizePeer(peer, err)
 			continue
 		}
+		n.rewardPeer(peer)
 
-		err = n.joinKnownPeers(peer)
+		err = n.checkSameChain(status.ChainID, status.GenesisHash)
 		if err != nil {
-			log.Printf("Error after joining peers: %s\n", err)
+			log.Printf("Peer %s is on another chain and was removed. Err: %s\n", peer.TcpAddress(), err)
+			n.RemovePeer(peer)
 			continue
 		}
 
-		err = n.syncBlocks(peer, status)
+		err = n.joinKnownPeers(peer)
 		if err != nil {
-			log.Printf("Error while synching blocks from peer. Err: %s\n", err)
+			log.Printf("Error after joining peers: %s\n", err)
+			n.penalizePeer(peer, err)
 			continue
 		}
 
+		// Peers are learnt first so block bodies can be downloaded from them too
 		log.Println("Synching known peers with node")
 		err = n.syncKnownPeers(peer, status)
 		if err != nil {
 			log.Printf("Error occurrec while synching known peers with the node. Err: %s\n", err)
 			continue
 		}
+
+		candidates = append(candidates, peerStatus{peer, status})
+	}
+
+	n.syncFromBestPeer(candidates)
+
+	for _, c := range candidates {
+		err := n.syncMempool(c.peer)
+		if err != nil {
+			log.Printf("Error while synching pending txs from peer %s. Err: %s\n", c.peer.TcpAddress(), err)
+			n.penalizePeer(c.peer, err)
+		}
+	}
+
+	err := n.persistPeers()
+	if err != nil {
+		log.Printf("Error while saving the known peers. Err: %s\n", err)
+	}
+}
+
+// syncFromBestPeer syncs blocks from the peer with the highest chain,
+// falling back to the next highest ones if it fails
+func (n *Node) syncFromBestPeer(candidates []peerStatus) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].status.Number != candidates[j].status.Number {
+			return candidates[i].status.Number > candidates[j].status.Number
+		}
+		return candidates[i].peer.TcpAddress() < candidates[j].peer.TcpAddress()
+	})
+
+	for _, c := range candidates {
+		if !n.isBehind(c.status) {
+			log.Println("No peer is ahead of this node")
+			return
+		}
+
+		log.Printf("Best peer is %s at block #%d\n", c.peer.TcpAddress(), c.status.Number)
+		err := n.syncBlocks(c.peer, c.status, candidates)
+		if err == nil {
+			// Only a peer we actually synced from is reported as the best one
+			n.setBestPeer(c.peer.TcpAddress())
+			n.rewardPeer(c.peer)
+			return
+		}
+		n.penalizePeer(c.peer, err)
+		log.Printf("Error while synching blocks from peer %s, falling back to the next best peer. Err: %s\n", c.peer.TcpAddress(), err)
+	}
+}
+
+// isBehind tells if the peer's chain is higher than ours
+func (n *Node) isBehind(status StatusRes) bool {
+	if status.Hash.IsEmpty() {
+		return false
+	}
+	hash, header := n.latestBlock()
+	if hash.IsEmpty() {
+		return true
 	}
+	return status.Number > header.Number
 }
 
-func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
+// syncBlocks syncs the header chain of the peer, downloading the bodies from it and the other candidates
+func (n *Node) syncBlocks(peer PeerNode, status StatusRes, candidates []peerStatus) error {
 	log.Println("Syncing peer nodes")
-	localBlockNumber := n.state.LatestBlock().Header.Number
+	localBlockHash, localBlock := n.latestBlock()
+	localBlockNumber := localBlock.Number
 	log.Println("Checking if the peer has no blocks")
 	if status.Hash.IsEmpty() {
 		log.Println("Peer has 0 blocks. Ignoring sync")
 		return nil
 	}
 	log.Println("Checking if the peer has only genesis block")
-	if status.Number == 0 && !n.state.LatestBlockHash().IsEmpty() {
+	if status.Number == 0 && !localBlockHash.IsEmpty() {
 		log.Println("Peer has only genesis block. Ignoring sync")
 		return nil
 	}
@@ -83,14 +169,136 @@ func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
 		newBlocksCount = 1
 	}
 	log.Printf("Found %d new blocks from Peer %s\n", newBlocksCount, peer.TcpAddress())
-	log.Printf("Fetching the remaining blocks from nodes latest block hash: %s\n", n.state.LatestBlockHash())
-	blocks, err := fetchBlocksFromPeer(peer, n.state.LatestBlockHash()) // From this block hash fetch the remaining blocks
+	log.Printf("Fetching the remaining blocks from nodes latest block hash: %s\n", localBlockHash)
+	// Headers first: the header chain comes from this peer, the bodies from any peer
+	// The locator lets the peer find where our chains diverge, if they do
+	locator, err := database.GetLocator(localBlockHash, n.dataDir)
 	if err != nil {
-		log.Println("Error while fetching blocks from peer")
-		return err
+		return fmt.Errorf("%w: %s", errLocalFailure, err.Error())
+	}
+
+	// Blocks extending our chain are added batch by batch. A fork is only switched to
+	// once all of its blocks are downloaded, it is validated as a whole.
+	var ancestor database.Hash
+	forkBlocks := make([]database.Block, 0)
+	for first := true; ; first = false {
+		headersRes, err := fetchHeadersFromPeer(peer, locator, syncBatchSize)
+		if err != nil {
+			log.Println("Error while fetching headers from peer")
+			return err
+		}
+		if len(headersRes.Headers) == 0 {
+			break
+		}
+
+		// The peer can only point at a block we asked about, or at none if our chains share no block
+		shareNone := first && headersRes.Ancestor.IsEmpty()
+		if !shareNone && !inLocator(headersRes.Ancestor, locator) {
+			return fmt.Errorf("%w: peer %s answered with ancestor '%x' which is not in our locator", errInvalidBlocks, peer.TcpAddress(), headersRes.Ancestor)
+		}
+		if first {
+			ancestor = headersRes.Ancestor
+		}
+
+		err = checkHeaderChain(headersRes.Ancestor, headersRes.Headers)
+		if err != nil {
+			return fmt.Errorf("%w: headers from peer %s. %s", errInvalidBlocks, peer.TcpAddress(), err.Error())
+		}
+
+		blocks, err := n.downloadBodies(headersRes.Headers, n.bodyPeers(peerStatus{peer, status}, candidates, headersRes.Headers))
+		if err != nil {
+			return err
+		}
+
+		if ancestor == localBlockHash {
+			err = n.addSyncedBlocks(blocks)
+			if err != nil {
+				return err
+			}
+		} else {
+			forkBlocks = append(forkBlocks, blocks...)
+		}
+
+		if !headersRes.More {
+			break
+		}
+		log.Printf("Synced %d blocks up to '%x', more to come\n", len(blocks), headersRes.Next)
+		locator = []database.Hash{headersRes.Next}
 	}
 
-	return n.state.AddBlocks(blocks)
+	if len(forkBlocks) == 0 {
+		return nil
+	}
+	if forkTip := forkBlocks[len(forkBlocks)-1].Header.Number; forkTip <= localBlockNumber {
+		return fmt.Errorf("%w: peer %s reported block #%d but its fork ends at block #%d", errInvalidBlocks, peer.TcpAddress(), status.Number, forkTip)
+	}
+	return n.switchFork(ancestor, forkBlocks)
+}
+
+// inLocator tells if the ancestor is one of the locator hashes
+func inLocator(ancestor database.Hash, locator []database.Hash) bool {
+	for _, hash := range locator {
+		if hash == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// addSyncedBlocks adds blocks following our latest block
+func (n *Node) addSyncedBlocks(blocks []database.Block) error {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+
+	// A block we produced or received meanwhile is not the peer's fault
+	if latest := n.state.LatestBlockHash(); blocks[0].Header.Parent != latest {
+		return fmt.Errorf("%w: our latest block moved to '%x' while syncing", errLocalFailure, latest)
+	}
+
+	for _, b := range blocks {
+		n.markTxsSeen(b)
+	}
+	return syncedBlocksErr(n.state.AddBlocks(blocks))
+}
+
+// syncedBlocksErr tells blocks failing validation apart from this node failing to store them
+func syncedBlocksErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, database.ErrInvalidBlock) {
+		return fmt.Errorf("%w: %s", errInvalidBlocks, err.Error())
+	}
+	return fmt.Errorf("%w: %s", errLocalFailure, err.Error())
+}
+
+// switchFork replaces our blocks after the ancestor with the peer's fork if it is higher.
+// The txs of our dropped blocks the fork didn't include go back to the mempool if still valid.
+func (n *Node) switchFork(ancestor database.Hash, blocks []database.Block) error {
+	n.stateMu.Lock()
+	defer n.stateMu.Unlock()
+
+	forkTip := blocks[len(blocks)-1].Header.Number
+	if latest := n.state.LatestBlock().Header.Number; forkTip <= latest {
+		return fmt.Errorf("%w: our chain grew to block #%d while syncing, past the fork ending at block #%d", errLocalFailure, latest, forkTip)
+	}
+
+	log.Printf("Our chain diverged from the peer's after block '%x'. Switching to the peer's chain\n", ancestor)
+	pending, err := n.state.SwitchFork(ancestor, blocks)
+	if err != nil {
+		return syncedBlocksErr(err)
+	}
+
+	for _, b := range blocks {
+		n.markTxsSeen(b)
+	}
+	for _, tx := range pending {
+		err = n.state.AddTx(tx, n.nextBlockHeader())
+		if err != nil {
+			log.Printf("Dropping tx of the abandoned chain from the mempool. Err: %s\n", err)
+		}
+	}
+	return nil
 }
 
 func (n *Node) joinKnownPeers(peer PeerNode) error {
@@ -100,14 +308,19 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 		return nil
 	}
 
+	chainID, genesisHash := n.chain()
 	url := fmt.Sprintf(
-		"http://%s%s?%s=%s&%s=%d",
+		"http://%s%s?%s=%s&%s=%d&%s=%s&%s=%s",
 		peer.TcpAddress(),
 		endPointAddPeer,
 		endPointAddPeerQueryKeyIP,
 		n.ip,
 		endpointAddPeerQueryKeyPort,
 		n.port,
+		endpointAddPeerQueryKeyChainID,
+		neturl.QueryEscape(chainID),
+		endpointAddPeerQueryKeyGenesisHash,
+		genesisHash.Hex(),
 	)
 
 	log.Printf("Url generated for peer: %s\n", url)
@@ -129,7 +342,7 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 		return fmt.Errorf(addPeerRes.Error)
 	}
 
-	knownPeer := n.knownPeers[peer.TcpAddress()]
+	knownPeer := n.Peers()[peer.TcpAddress()]
 	knownPeer.connected = addPeerRes.Success
 
 	n.AddPeer(knownPeer)
@@ -144,7 +357,7 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 
 func queryPeerStatus(peer PeerNode) (StatusRes, error) {
 	url := fmt.Sprintf("http://%s%s", peer.TcpAddress(), endPointStatus)
-	res, err := http.Get(url)
+	res, err := syncClient.Get(url)
 	if err != nil {
 		return StatusRes{}, err
 	}
@@ -158,36 +371,6 @@ func queryPeerStatus(peer PeerNode) (StatusRes, error) {
 	return statusRes, nil
 }
 
-func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash) ([]database.Block, error) {
-	log.Printf("Importing blocks from Peer %s...\n", peer.TcpAddress())
-
-	// Make this a common attribute
-	url := fmt.Sprintf(
-		"http://%s%s?%s=%s",
-		peer.TcpAddress(),
-		endPointSync,
-		endpointSyncQueryFromBlock,
-		fromBlock.Hex(),
-	)
-
-	log.Printf("Import URL generated for Peer: %s\n", url)
-
-	res, err := http.Get(url)
-	if err != nil {
-		log.Print("Error while performing GET")
-		return nil, err
-	}
-
-	syncRes := SyncRes{}
-	err = readRes(res, &syncRes)
-	if err != nil {
-		log.Print("Error while reading response")
-		return nil, err
-	}
-
-	return syncRes.Blocks, nil
-}
-
 func (n *Node) syncKnownPeers(peer PeerNode, status StatusRes) error {
 	for _, statusPeer := range status.KnownPeers {
 		if !n.IsKnownPeer(statusPeer) {
@@ -198,3 +381,29 @@ func (n *Node) syncKnownPeers(peer PeerNode, status StatusRes) error {
 	}
 	return nil
 }
+
+// requestSync wakes up the sync loop unless a sync is already requested
+func (n *Node) requestSync() {
+	select {
+	case n.syncNow <- struct{}{}:
+	default:
+	}
+}
+
+// prune discards old block bodies once a snapshot covers them, if the node runs in prune mode
+func (n *Node) prune() {
+	if n.pruneDepth == 0 {
+		return
+	}
+
+	n.stateMu.Lock()
+	err := n.state.Prune(n.pruneDepth)
+	n.stateMu.Unlock()
+	if err == database.ErrNoSnapshot {
+		log.Println("No snapshot yet. Keeping all block bodies")
+		return
+	}
+	if err != nil {
+		log.Printf("Error while pruning blocks. Err: %s\n", err)
+	}
+}
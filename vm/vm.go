@@ -0,0 +1,276 @@
+// Package vm runs contract bytecode on a deterministic stack machine of 64 bit words.
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	OpStop      byte = 0x00
+	OpPush      byte = 0x01 // followed by an 8 byte big endian word
+	OpPop       byte = 0x02
+	OpDup       byte = 0x03
+	OpSwap      byte = 0x04
+	OpAdd       byte = 0x10
+	OpSub       byte = 0x11
+	OpMul       byte = 0x12
+	OpDiv       byte = 0x13
+	OpMod       byte = 0x14
+	OpEq        byte = 0x20
+	OpLt        byte = 0x21
+	OpGt        byte = 0x22
+	OpNot       byte = 0x23
+	OpJump      byte = 0x30 // jumps to the position popped from the stack
+	OpJumpI     byte = 0x31 // pops a position and a condition, jumps if the condition isn't 0
+	OpSLoad     byte = 0x40 // pops a key, pushes its value in the contract storage
+	OpSStore    byte = 0x41 // pops a key and a value, stores the value under the key
+	OpCallData  byte = 0x50 // pops an index, pushes that word of the call input (0 past its end)
+	OpCallValue byte = 0x51 // pushes the TOK value sent with the call
+	OpLog       byte = 0x60 // pops a count n, then logs the n words below it
+	OpRevert    byte = 0xfe
+)
+
+const maxStackSize = 1024
+
+var ErrOutOfSteps = errors.New("contract ran out of steps")
+var ErrRevert = errors.New("contract reverted")
+var ErrStackUnderflow = errors.New("stack underflow")
+var ErrStackOverflow = errors.New("stack overflow")
+var ErrInvalidJump = errors.New("invalid jump destination")
+var ErrInvalidOpcode = errors.New("invalid opcode")
+var ErrDivisionByZero = errors.New("division by zero")
+
+// Storage is the key-value store of a contract
+type Storage map[uint64]uint64
+
+func (st Storage) Copy() Storage {
+	c := make(Storage)
+	for k, v := range st {
+		c[k] = v
+	}
+	return c
+}
+
+// Call is the input of a contract execution
+type Call struct {
+	Input []uint64
+	Value uint64
+}
+
+// Result is the outcome of a contract execution
+type Result struct {
+	Storage Storage
+	Steps   uint64
+	Logs    [][]uint64
+}
+
+type machine struct {
+	code    []byte
+	pc      int
+	stack   []uint64
+	storage Storage
+	call    Call
+	logs    [][]uint64
+}
+
+// Execute runs the code until it stops or maxSteps instructions were executed.
+// The storage passed in is never modified. On error only the steps taken are returned,
+// the storage and logs of the failed execution must be discarded.
+func Execute(code []byte, storage Storage, call Call, maxSteps uint64) (Result, error) {
+	m := &machine{code: code, stack: make([]uint64, 0), storage: storage.Copy(), call: call}
+
+	steps := uint64(0)
+	for m.pc < len(m.code) {
+		if steps >= maxSteps {
+			return Result{Steps: steps}, ErrOutOfSteps
+		}
+		steps++
+
+		op := m.code[m.pc]
+		m.pc++
+		if op == OpStop {
+			break
+		}
+
+		err := m.step(op)
+		if err != nil {
+			return Result{Steps: steps}, fmt.Errorf("%w at position %d", err, m.pc-1)
+		}
+	}
+
+	return Result{m.storage, steps, m.logs}, nil
+}
+
+func (m *machine) step(op byte) error {
+	switch op {
+	case OpPush:
+		if m.pc+8 > len(m.code) {
+			return ErrInvalidOpcode
+		}
+		word := binary.BigEndian.Uint64(m.code[m.pc : m.pc+8])
+		m.pc += 8
+		return m.push(word)
+	case OpPop:
+		_, err := m.pop()
+		return err
+	case OpDup:
+		a, err := m.pop()
+		if err != nil {
+			return err
+		}
+		m.push(a)
+		return m.push(a)
+	case OpSwap:
+		a, b, err := m.pop2()
+		if err != nil {
+			return err
+		}
+		m.push(a)
+		return m.push(b)
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpEq, OpLt, OpGt:
+		return m.binaryOp(op)
+	case OpNot:
+		a, err := m.pop()
+		if err != nil {
+			return err
+		}
+		return m.push(boolWord(a == 0))
+	case OpJump:
+		dest, err := m.pop()
+		if err != nil {
+			return err
+		}
+		return m.jump(dest)
+	case OpJumpI:
+		dest, cond, err := m.pop2()
+		if err != nil {
+			return err
+		}
+		if cond == 0 {
+			return nil
+		}
+		return m.jump(dest)
+	case OpSLoad:
+		key, err := m.pop()
+		if err != nil {
+			return err
+		}
+		return m.push(m.storage[key])
+	case OpSStore:
+		key, value, err := m.pop2()
+		if err != nil {
+			return err
+		}
+		m.storage[key] = value
+		return nil
+	case OpCallData:
+		i, err := m.pop()
+		if err != nil {
+			return err
+		}
+		if i >= uint64(len(m.call.Input)) {
+			return m.push(0)
+		}
+		return m.push(m.call.Input[i])
+	case OpCallValue:
+		return m.push(m.call.Value)
+	case OpLog:
+		n, err := m.pop()
+		if err != nil {
+			return err
+		}
+		if n > uint64(len(m.stack)) {
+			return ErrStackUnderflow
+		}
+		words := make([]uint64, n)
+		copy(words, m.stack[uint64(len(m.stack))-n:])
+		m.stack = m.stack[:uint64(len(m.stack))-n]
+		m.logs = append(m.logs, words)
+		return nil
+	case OpRevert:
+		return ErrRevert
+	}
+
+	return fmt.Errorf("%w 0x%02x", ErrInvalidOpcode, op)
+}
+
+// binaryOp pops b then a and pushes a op b, arithmetic wraps around like uint64
+func (m *machine) binaryOp(op byte) error {
+	b, a, err := m.pop2()
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case OpAdd:
+		return m.push(a + b)
+	case OpSub:
+		return m.push(a - b)
+	case OpMul:
+		return m.push(a * b)
+	case OpDiv:
+		if b == 0 {
+			return ErrDivisionByZero
+		}
+		return m.push(a / b)
+	case OpMod:
+		if b == 0 {
+			return ErrDivisionByZero
+		}
+		return m.push(a % b)
+	case OpEq:
+		return m.push(boolWord(a == b))
+	case OpLt:
+		return m.push(boolWord(a < b))
+	case OpGt:
+		return m.push(boolWord(a > b))
+	}
+	return ErrInvalidOpcode
+}
+
+func (m *machine) jump(dest uint64) error {
+	if dest >= uint64(len(m.code)) {
+		return ErrInvalidJump
+	}
+	m.pc = int(dest)
+	return nil
+}
+
+func (m *machine) push(word uint64) error {
+	if len(m.stack) >= maxStackSize {
+		return ErrStackOverflow
+	}
+	m.stack = append(m.stack, word)
+	return nil
+}
+
+func (m *machine) pop() (uint64, error) {
+	if len(m.stack) == 0 {
+		return 0, ErrStackUnderflow
+	}
+	word := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return word, nil
+}
+
+// pop2 pops the top of the stack and then the word below it
+func (m *machine) pop2() (uint64, uint64, error) {
+	a, err := m.pop()
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := m.pop()
+	if err != nil {
+		return 0, 0, err
+	}
+	return a, b, nil
+}
+
+func boolWord(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
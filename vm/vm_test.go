@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// asm concatenates opcodes and pushed words into bytecode
+func asm(parts ...[]byte) []byte {
+	code := make([]byte, 0)
+	for _, p := range parts {
+		code = append(code, p...)
+	}
+	return code
+}
+
+func op(o byte) []byte {
+	return []byte{o}
+}
+
+func push(word uint64) []byte {
+	b := make([]byte, 9)
+	b[0] = OpPush
+	binary.BigEndian.PutUint64(b[1:], word)
+	return b
+}
+
+// store saves the top of the stack under key 0 so tests can read it from the storage
+func store() []byte {
+	return asm(push(0), op(OpSStore))
+}
+
+func TestExecuteOpcodes(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		call Call
+		want uint64
+	}{
+		{"add", asm(push(2), push(3), op(OpAdd), store()), Call{}, 5},
+		{"sub", asm(push(5), push(3), op(OpSub), store()), Call{}, 2},
+		{"sub wraps", asm(push(0), push(1), op(OpSub), store()), Call{}, math.MaxUint64},
+		{"mul", asm(push(4), push(5), op(OpMul), store()), Call{}, 20},
+		{"div", asm(push(7), push(2), op(OpDiv), store()), Call{}, 3},
+		{"mod", asm(push(7), push(2), op(OpMod), store()), Call{}, 1},
+		{"eq", asm(push(3), push(3), op(OpEq), store()), Call{}, 1},
+		{"lt", asm(push(2), push(3), op(OpLt), store()), Call{}, 1},
+		{"gt", asm(push(2), push(3), op(OpGt), store()), Call{}, 0},
+		{"not", asm(push(0), op(OpNot), store()), Call{}, 1},
+		{"dup", asm(push(6), op(OpDup), op(OpAdd), store()), Call{}, 12},
+		{"swap", asm(push(10), push(3), op(OpSwap), op(OpSub), store()), Call{}, math.MaxUint64 - 6},
+		{"pop", asm(push(1), push(2), op(OpPop), store()), Call{}, 1},
+		{"sload", asm(push(9), push(1), op(OpSStore), push(1), op(OpSLoad), store()), Call{}, 9},
+		{"calldata", asm(push(1), op(OpCallData), store()), Call{Input: []uint64{4, 8}}, 8},
+		{"calldata past the input", asm(push(5), op(OpCallData), store()), Call{Input: []uint64{4}}, 0},
+		{"callvalue", asm(op(OpCallValue), store()), Call{Value: 42}, 42},
+		// jumpi to the push(2) at position 39 skips the push(1)
+		{"jumpi taken", asm(push(1), push(39), op(OpJumpI), push(1), store(), op(OpStop), push(2), store()), Call{}, 2},
+		{"jumpi not taken", asm(push(0), push(39), op(OpJumpI), push(1), store(), op(OpStop), push(2), store()), Call{}, 1},
+		{"stop", asm(push(1), store(), op(OpStop), push(2), store()), Call{}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Execute(tt.code, Storage{}, tt.call, 1000)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if res.Storage[0] != tt.want {
+				t.Errorf("got %d, want %d", res.Storage[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	// push 1, push 0, jump to 0: the stack grows by one word every loop
+	pushForever := asm(push(1), push(0), op(OpJump))
+
+	tests := []struct {
+		name string
+		code []byte
+		want error
+	}{
+		{"stack underflow", asm(push(1), op(OpAdd)), ErrStackUnderflow},
+		{"log underflow", asm(push(1), push(2), op(OpLog)), ErrStackUnderflow},
+		{"stack overflow", pushForever, ErrStackOverflow},
+		{"division by zero", asm(push(1), push(0), op(OpDiv)), ErrDivisionByZero},
+		{"modulo by zero", asm(push(1), push(0), op(OpMod)), ErrDivisionByZero},
+		{"invalid opcode", op(0xff), ErrInvalidOpcode},
+		{"truncated push", []byte{OpPush, 0, 0, 1}, ErrInvalidOpcode},
+		{"invalid jump", asm(push(100), op(OpJump)), ErrInvalidJump},
+		{"revert", asm(push(1), store(), op(OpRevert)), ErrRevert},
+		{"out of steps", asm(push(0), op(OpJump)), ErrOutOfSteps},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Execute(tt.code, Storage{}, Call{}, 10000)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if res.Storage != nil || res.Logs != nil {
+				t.Errorf("failed execution returned storage %v and logs %v", res.Storage, res.Logs)
+			}
+		})
+	}
+}
+
+func TestExecuteStepLimit(t *testing.T) {
+	loop := asm(push(0), op(OpJump))
+
+	res, err := Execute(loop, Storage{}, Call{}, 100)
+	if !errors.Is(err, ErrOutOfSteps) {
+		t.Fatalf("got error %v, want %v", err, ErrOutOfSteps)
+	}
+	if res.Steps != 100 {
+		t.Errorf("got %d steps, want 100", res.Steps)
+	}
+
+	// push, push, add and stop
+	res, err = Execute(asm(push(1), push(2), op(OpAdd), op(OpStop)), Storage{}, Call{}, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.Steps != 4 {
+		t.Errorf("got %d steps, want 4", res.Steps)
+	}
+}
+
+func TestExecuteLeavesStorageUntouched(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+	}{
+		{"success", asm(push(99), push(1), op(OpSStore))},
+		{"revert", asm(push(99), push(1), op(OpSStore), op(OpRevert))},
+		{"out of steps", asm(push(99), push(1), op(OpSStore), push(19), op(OpJump))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := Storage{1: 10}
+			Execute(tt.code, storage, Call{}, 100)
+			if !reflect.DeepEqual(storage, Storage{1: 10}) {
+				t.Errorf("storage passed in was modified to %v", storage)
+			}
+		})
+	}
+}
+
+func TestExecuteLogs(t *testing.T) {
+	code := asm(push(7), push(8), push(2), op(OpLog), push(9), push(1), op(OpLog))
+
+	res, err := Execute(code, Storage{}, Call{}, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := [][]uint64{{7, 8}, {9}}
+	if !reflect.DeepEqual(res.Logs, want) {
+		t.Errorf("got logs %v, want %v", res.Logs, want)
+	}
+}